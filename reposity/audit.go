@@ -0,0 +1,288 @@
+package reposity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// AuditOp is the operation recorded by an audit entry
+type AuditOp string
+
+const (
+	AuditCreate AuditOp = "CREATE"
+	AuditUpdate AuditOp = "UPDATE"
+	AuditDelete AuditOp = "DELETE"
+)
+
+// RedactedValue replace the values of redacted fields in audit entries
+const RedactedValue = "[REDACTED]"
+
+// AuditEntry is a change of an audited item, written in the transaction of the change
+type AuditEntry struct {
+	ID        int64           `gorm:"primaryKey"`
+	Entity    string          `gorm:"not null;index:idx_audit_entry_item,priority:1"` // table of the entity
+	EntityID  string          `gorm:"not null;index:idx_audit_entry_item,priority:2"` // primary key, composite keys joined by ","
+	Operation AuditOp         `gorm:"not null"`
+	Actor     string          `gorm:"index"` // see WithActor
+	RequestID string          // see WithRequestID
+	Changes   json.RawMessage `gorm:"type:jsonb"` // changed columns: {"name": {"old": "a", "new": "b"}}
+	CreatedAt time.Time       `gorm:"index"`
+}
+
+// FieldChange is the change of a column in AuditEntry.Changes, Old is missing for creates
+// and New for deletes
+type FieldChange struct {
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+// AuditOptions configure the audit of an entity
+type AuditOptions struct {
+	// Redact list the fields (column or Go field names) whose values are replaced by RedactedValue,
+	// their changes are still recorded
+	Redact []string
+}
+
+var (
+	auditMu sync.RWMutex
+	audited = map[reflect.Type]AuditOptions{}
+)
+
+type actorKey struct{}
+
+type requestIDKey struct{}
+
+// MigrateAudit create the audit table
+func MigrateAudit() error {
+	return Migrate(&AuditEntry{})
+}
+
+// RegisterAudit enable the audit of entity E: every helper creating, updating or deleting items of E
+// writes an AuditEntry in the transaction of the change, the helpers running hooks (see RegisterHooks).
+// Bulk helpers then write the items one by one, and upserts need ConflictColumns or the primary key as
+// conflict target. Items reached through a cascade are not audited
+func RegisterAudit[E any](opts AuditOptions) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	audited[reflect.TypeOf((*E)(nil)).Elem()] = opts
+}
+
+// WithActor return a copy of ctx carrying the user or service recorded in audit entries
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext return the actor set by WithActor
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// WithRequestID return a copy of ctx carrying the request ID recorded in audit entries
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext return the request ID set by WithRequestID
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// ReadAuditHistory read the audit entries of the item of entity E whose primary key is id, newest first,
+// accepts generic types
+//
+// It return entries and error
+func ReadAuditHistory[E any, K comparable](ctx context.Context, id K, limit int, page int) ([]AuditEntry, error) {
+	if !Connected {
+		return nil, ErrNotConnected
+	}
+	if limit < 1 {
+		limit = 100
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	db := defaultDB.WithContext(ctx)
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := primaryKeyFields[E](db)
+	if err != nil {
+		return nil, err
+	}
+	values, err := primaryKeyValues(db, fields, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []AuditEntry
+	err = db.Where(&AuditEntry{Entity: entitySchema.Table, EntityID: joinKeyValues(values)}).
+		Order("created_at DESC, id DESC").
+		Limit(limit).Offset(limit * (page - 1)).
+		Find(&entries).Error
+	return entries, err
+}
+
+// FieldChanges decode the changes of the entry
+func (entry AuditEntry) FieldChanges() (map[string]FieldChange, error) {
+	changes := map[string]FieldChange{}
+	if len(entry.Changes) == 0 {
+		return changes, nil
+	}
+	err := json.Unmarshal(entry.Changes, &changes)
+	return changes, err
+}
+
+// isAudited report whether the audit of entity E is enabled
+func isAudited[E any]() bool {
+	_, ok := auditOptionsFor[E]()
+	return ok
+}
+
+// auditOptionsFor return the audit options of entity E
+func auditOptionsFor[E any]() (AuditOptions, bool) {
+	auditMu.RLock()
+	defer auditMu.RUnlock()
+	opts, ok := audited[reflect.TypeOf((*E)(nil)).Elem()]
+	return opts, ok
+}
+
+// auditSnapshot encode the columns of item as JSON, nil if E is not audited.
+// Automatic creation and update times are left out, the entry has its own time
+func auditSnapshot[E any](db *gorm.DB, item *E) (map[string]json.RawMessage, error) {
+	if !isAudited[E]() {
+		return nil, nil
+	}
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := statementContext(db)
+	itemValue := reflect.ValueOf(item).Elem()
+	snapshot := make(map[string]json.RawMessage, len(entitySchema.Fields))
+	for _, field := range entitySchema.Fields {
+		if field.DBName == "" || field.AutoCreateTime != 0 || field.AutoUpdateTime != 0 {
+			continue
+		}
+		value, _ := field.ValueOf(ctx, itemValue)
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("audit %s.%s: %w", entitySchema.Name, field.Name, err)
+		}
+		snapshot[field.DBName] = data
+	}
+	return snapshot, nil
+}
+
+// writeAudit write the audit entry of a change of item with db, if E is audited. before is the
+// snapshot of the stored item (nil for creates), after of the written item (nil for deletes).
+// Updates changing no column are not recorded
+func writeAudit[E any](db *gorm.DB, op AuditOp, item *E, before, after map[string]json.RawMessage) error {
+	opts, ok := auditOptionsFor[E]()
+	if !ok {
+		return nil
+	}
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return err
+	}
+
+	changes := auditChanges(before, after)
+	if op == AuditUpdate && len(changes) == 0 {
+		return nil
+	}
+	redactChanges(entitySchema, changes, opts.Redact)
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	// Primary key, read after creation
+	ctx := statementContext(db)
+	values := make([]interface{}, len(entitySchema.PrimaryFields))
+	for i, field := range entitySchema.PrimaryFields {
+		values[i], _ = field.ValueOf(ctx, reflect.ValueOf(item).Elem())
+	}
+
+	entry := AuditEntry{
+		Entity:    entitySchema.Table,
+		EntityID:  joinKeyValues(values),
+		Operation: op,
+		Actor:     ActorFromContext(ctx),
+		RequestID: RequestIDFromContext(ctx),
+		Changes:   data,
+	}
+	if err := db.Session(&gorm.Session{NewDB: true}).Create(&entry).Error; err != nil {
+		return fmt.Errorf("write audit entry: %w", err)
+	}
+	return nil
+}
+
+// auditUpdate write the audit entry of the update of item, before is the snapshot of the stored item
+func auditUpdate[E any](db *gorm.DB, item *E, before map[string]json.RawMessage) error {
+	after, err := auditSnapshot(db, item)
+	if err != nil {
+		return err
+	}
+	return writeAudit(db, AuditUpdate, item, before, after)
+}
+
+// auditChanges compare two snapshots of an item and return the changed columns
+func auditChanges(before, after map[string]json.RawMessage) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	for column, value := range after {
+		if old, ok := before[column]; !ok || !bytes.Equal(old, value) {
+			changes[column] = FieldChange{Old: old, New: value}
+		}
+	}
+	for column, old := range before {
+		if _, ok := after[column]; !ok {
+			changes[column] = FieldChange{Old: old}
+		}
+	}
+	return changes
+}
+
+// redactChanges replace the values of the redacted fields
+func redactChanges(s *schema.Schema, changes map[string]FieldChange, redact []string) {
+	redacted, _ := json.Marshal(RedactedValue)
+	for _, name := range redact {
+		column := name
+		if field := s.LookUpField(name); field != nil {
+			column = field.DBName
+		}
+		change, ok := changes[column]
+		if !ok {
+			continue
+		}
+		if change.Old != nil {
+			change.Old = redacted
+		}
+		if change.New != nil {
+			change.New = redacted
+		}
+		changes[column] = change
+	}
+}
+
+// joinKeyValues format primary key values as an audit entity ID
+func joinKeyValues(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprint(value)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,178 @@
+package reposity
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type auditUser struct {
+	ID       int64 `gorm:"primaryKey"`
+	Name     string
+	Email    string
+	Password string
+	Nick     *string
+}
+
+type auditUserDTO struct {
+	Name     string  `json:"name"`
+	Email    string  `json:"email"`
+	Password string  `json:"password"`
+	Nick     *string `json:"nick"`
+}
+
+func TestAuditUpdateChanges(t *testing.T) {
+	db := newTestDB(t)
+	RegisterAudit[auditUser](AuditOptions{Redact: []string{"Password"}})
+	nick := "bob"
+
+	tests := []struct {
+		name string
+		dto  auditUserDTO
+		want map[string]FieldChange
+	}{
+		{
+			name: "partial update",
+			dto:  auditUserDTO{Name: "Robert"},
+			want: map[string]FieldChange{"name": {Old: json.RawMessage(`"Bob"`), New: json.RawMessage(`"Robert"`)}},
+		},
+		{
+			name: "same values",
+			dto:  auditUserDTO{Name: "Bob", Email: "bob@example.com"},
+			want: map[string]FieldChange{},
+		},
+		{
+			name: "pointer field",
+			dto:  auditUserDTO{Nick: &nick},
+			want: map[string]FieldChange{"nick": {Old: json.RawMessage(`null`), New: json.RawMessage(`"bob"`)}},
+		},
+		{
+			name: "redacted field",
+			dto:  auditUserDTO{Password: "new"},
+			want: map[string]FieldChange{"password": {Old: json.RawMessage(`"[REDACTED]"`), New: json.RawMessage(`"[REDACTED]"`)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := auditUser{ID: 1, Name: "Bob", Email: "bob@example.com", Password: "old"}
+			before, err := auditSnapshot(db, &item)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mapped auditUser
+			if err := MapToEntity(&mapped, tt.dto); err != nil {
+				t.Fatal(err)
+			}
+			if err := assignNonZeroFields(db, &item, &mapped); err != nil {
+				t.Fatal(err)
+			}
+			after, err := auditSnapshot(db, &item)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entitySchema, err := parseEntitySchema[auditUser](db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes := auditChanges(before, after)
+			redactChanges(entitySchema, changes, []string{"Password"})
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("changes = %s, want %s", marshalChanges(t, changes), marshalChanges(t, tt.want))
+			}
+		})
+	}
+}
+
+func TestAuditCreateAndDeleteChanges(t *testing.T) {
+	snapshot := map[string]json.RawMessage{"id": json.RawMessage(`1`), "name": json.RawMessage(`"Bob"`)}
+
+	created := auditChanges(nil, snapshot)
+	if len(created) != 2 || created["name"].Old != nil || string(created["name"].New) != `"Bob"` {
+		t.Errorf("create changes = %s", marshalChanges(t, created))
+	}
+	deleted := auditChanges(snapshot, nil)
+	if len(deleted) != 2 || deleted["name"].New != nil || string(deleted["name"].Old) != `"Bob"` {
+		t.Errorf("delete changes = %s", marshalChanges(t, deleted))
+	}
+}
+
+type auditHookItem struct {
+	ID   int64 `gorm:"primaryKey"`
+	Name string
+}
+
+func TestAuditWithHooks(t *testing.T) {
+	RegisterAudit[auditHookItem](AuditOptions{})
+	db := newTestDB(t).Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true})
+	var entries []AuditEntry
+	err := db.Callback().Create().After("gorm:create").Register("test:audit", func(tx *gorm.DB) {
+		if entry, ok := tx.Statement.Dest.(*AuditEntry); ok {
+			entries = append(entries, *entry)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func() error { return nil }
+
+	item := auditHookItem{ID: 1, Name: "Bob"}
+	var dto auditHookItem
+	if err := afterCreate(db, nil, &dto, &item); err != nil {
+		t.Fatal(err)
+	}
+	old := item
+	item.Name = "Robert"
+	if err := updateEntityWithHooks(db, nil, &old, &item, write); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing changed, no entry
+	old = item
+	if err := updateWithHooks(db, nil, &old, &dto, &item, &dto, write); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteWithHooks(db, nil, &item, write); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		op      AuditOp
+		changes string
+	}{
+		{AuditCreate, `{"id":{"new":1},"name":{"new":"Bob"}}`},
+		{AuditUpdate, `{"name":{"old":"Bob","new":"Robert"}}`},
+		{AuditDelete, `{"id":{"old":1},"name":{"old":"Robert"}}`},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Operation != want[i].op || entry.EntityID != "1" || !sameJSON(t, entry.Changes, want[i].changes) {
+			t.Errorf("entry %d = %s %s %s, want %s %s", i, entry.Operation, entry.EntityID, entry.Changes, want[i].op, want[i].changes)
+		}
+	}
+}
+
+func sameJSON(t *testing.T, got []byte, want string) bool {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+func marshalChanges(t *testing.T, changes map[string]FieldChange) string {
+	t.Helper()
+	data, err := json.Marshal(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
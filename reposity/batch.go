@@ -0,0 +1,154 @@
+package reposity
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// DefaultBatchSize is the number of rows written per INSERT by CreateManyFromDTO
+const DefaultBatchSize = 100
+
+// ItemError is the failure of one item of a batch operation
+type ItemError struct {
+	Index int // index of the item in the input slice
+	Err   error
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func (e ItemError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError list the items of a batch operation that failed
+type BatchError struct {
+	Items []ItemError
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Items) == 1 {
+		return e.Items[0].Error()
+	}
+	return fmt.Sprintf("%d items failed, first %v", len(e.Items), e.Items[0])
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Items))
+	for i, item := range e.Items {
+		errs[i] = item
+	}
+	return errs
+}
+
+// CreateManyFromDTO validate and map all dtos (data transfer object) to new database's items,
+// then write them with multi-row INSERT ... RETURNING, batchSize rows per statement,
+// accepts generic types. The create hooks run for each item. Nothing is written if any item fails.
+//
+// It return created items with generated IDs and defaults, and a *BatchError listing the failed items
+func CreateManyFromDTO[M any, E any](dtos []M, batchSize int) ([]M, error) {
+	if !Connected {
+		return dtos, ErrNotConnected
+	}
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+
+	// Validate and map all items before writing anything
+	items := make([]E, len(dtos))
+	batchErr := &BatchError{}
+	for i := range dtos {
+		if err := validateItem[E](defaultDB, dtos[i], nil); err != nil {
+			batchErr.Items = append(batchErr.Items, ItemError{Index: i, Err: err})
+			continue
+		}
+		if err := MapToEntity(&items[i], dtos[i]); err != nil {
+			batchErr.Items = append(batchErr.Items, ItemError{Index: i, Err: err})
+		}
+	}
+	if len(batchErr.Items) > 0 {
+		return dtos, batchErr
+	}
+
+	// Insert batches in one transaction, between the create hooks of the items
+	registered := hooksFor[M, E]()
+	var created []M
+	err := transaction(context.Background(), "CreateManyFromDTO", false, func(tx *gorm.DB) error {
+		created = append([]M(nil), dtos...)
+		for i := range items {
+			if err := beforeCreate(tx, registered, &created[i], &items[i]); err != nil {
+				return &BatchError{Items: []ItemError{{Index: i, Err: err}}}
+			}
+		}
+
+		for start := 0; start < len(items); start += batchSize {
+			end := min(start+batchSize, len(items))
+			failed, err := insertBatch(tx, items[start:end])
+			if err != nil {
+				return err
+			}
+			for _, f := range failed {
+				batchErr.Items = append(batchErr.Items, ItemError{Index: start + f.Index, Err: f.Err})
+			}
+		}
+		if len(batchErr.Items) > 0 {
+			return batchErr
+		}
+
+		// Mapping back from created entities to DTOs
+		for i := range items {
+			if err := afterCreate(tx, registered, &created[i], &items[i]); err != nil {
+				return &BatchError{Items: []ItemError{{Index: i, Err: err}}}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return dtos, err
+	}
+	return created, nil
+}
+
+// insertBatch insert a batch inside a savepoint. When the batch fails, rows are retried one by one
+// so the failing rows can be reported, their indexes are relative to batch. Savepoints are released
+// once done, each open one is a subtransaction slowing down the rest of the transaction.
+//
+// It return error only when the transaction itself can not continue
+func insertBatch[E any](tx *gorm.DB, batch []E) (failed []ItemError, err error) {
+	if err := tx.SavePoint("reposity_batch").Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&batch).Error; err == nil {
+		return nil, releaseSavePoint(tx, "reposity_batch")
+	}
+	if err := tx.RollbackTo("reposity_batch").Error; err != nil {
+		return nil, err
+	}
+	if err := releaseSavePoint(tx, "reposity_batch"); err != nil {
+		return nil, err
+	}
+
+	for i := range batch {
+		if err := tx.SavePoint("reposity_row").Error; err != nil {
+			return failed, err
+		}
+		if err := tx.Create(&batch[i]).Error; err != nil {
+			failed = append(failed, ItemError{Index: i, Err: err})
+			if err := tx.RollbackTo("reposity_row").Error; err != nil {
+				return failed, err
+			}
+		}
+		if err := releaseSavePoint(tx, "reposity_row"); err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+// releaseSavePoint release a savepoint of tx, GORM only creates and rolls back to them
+func releaseSavePoint(tx *gorm.DB, name string) error {
+	return tx.Exec("RELEASE SAVEPOINT " + tx.Statement.Quote(name)).Error
+}
@@ -0,0 +1,329 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ErrUnfiltered is returned by UpdateWhere and DeleteWhere when the query has no condition
+// and AllowUnfiltered was not called
+var ErrUnfiltered = errors.New("refusing to update or delete without filter, call AllowUnfiltered to affect all items")
+
+// AllowUnfiltered allow UpdateWhere and DeleteWhere to run without any condition, on all items
+func (query *SQLQuery[M, E]) AllowUnfiltered() *SQLQuery[M, E] {
+	query.allowUnfiltered = true
+	return query
+}
+
+// ReturningIDs make UpdateWhere and DeleteWhere return the IDs of affected items
+func (query *SQLQuery[M, E]) ReturningIDs() *SQLQuery[M, E] {
+	query.returningIDs = true
+	return query
+}
+
+// UpdateWhere update all items matching current filter (actually patching). values is either
+// a map of column name to value, or a dto M whose empty (null) fields will not be updated.
+// With update hooks or audit, the items are locked and updated one by one, map values must then be
+// assignable to the fields of their column (no SQL expression)
+//
+// It return number of affected items, their IDs if ReturningIDs was called, and error
+func (query *SQLQuery[M, E]) UpdateWhere(values interface{}) (affected int64, ids []string, err error) {
+	if !Connected {
+		return 0, nil, ErrNotConnected
+	}
+	db, err := query.bulkDB()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Mapping from DTO to entity model, without primary key: GORM would add it to the filter
+	var dto *M
+	switch v := values.(type) {
+	case M:
+		dto = &v
+	case *M:
+		dto = v
+	}
+	if dto != nil {
+		var item E
+		if err := MapToEntity(&item, *dto); err != nil {
+			return 0, nil, err
+		}
+		if err := clearPrimaryKey(db, &item); err != nil {
+			return 0, nil, err
+		}
+		values = &item
+	}
+	if registered := updateHooksFor[E](); len(registered) > 0 || isAudited[E]() {
+		return query.updateEachWithHooks(values, registered)
+	}
+
+	var items []E
+	result := db.Model(&items).Where(query.expressStr, query.args...).Updates(values)
+	if result.Error != nil {
+		return 0, nil, result.Error
+	}
+	if query.returningIDs {
+		ids, err = primaryKeyStrings(db, items)
+	}
+	return result.RowsAffected, ids, err
+}
+
+// DeleteWhere delete all items matching current filter. Soft delete sets DeletedAt of entities
+// having a gorm.DeletedAt field, otherwise items are removed from the database. With delete hooks
+// or audit, the items are locked and deleted one by one
+//
+// It return number of affected items, their IDs if ReturningIDs was called, and error
+func (query *SQLQuery[M, E]) DeleteWhere(soft bool) (affected int64, ids []string, err error) {
+	if !Connected {
+		return 0, nil, ErrNotConnected
+	}
+	db, err := query.bulkDB()
+	if err != nil {
+		return 0, nil, err
+	}
+	if registered := deleteHooksFor[E](); len(registered) > 0 || isAudited[E]() {
+		return query.deleteEachWithHooks(soft, registered)
+	}
+	if !soft {
+		db = db.Unscoped()
+	}
+
+	var items []E
+	result := db.Where(query.expressStr, query.args...).Delete(&items)
+	if result.Error != nil {
+		return 0, nil, result.Error
+	}
+	if query.returningIDs {
+		ids, err = primaryKeyStrings(db, items)
+	}
+	return result.RowsAffected, ids, err
+}
+
+// updateEachWithHooks lock the items matching current filter, then update them one by one between
+// their update hooks. values is a *E whose non-empty fields are written, or a map of column to value
+func (query *SQLQuery[M, E]) updateEachWithHooks(values interface{}, registered []hooksEntry) (affected int64, ids []string, err error) {
+	entitySchema, err := parseEntitySchema[E](query.db)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = dbError(query.db.Transaction(func(tx *gorm.DB) error {
+		affected = 0
+		items, err := query.lockItems(tx)
+		if err != nil {
+			return err
+		}
+
+		// The filter already selected the items, they are written by primary key only
+		write := tx.Session(&gorm.Session{NewDB: true}).Unscoped()
+		for i := range items {
+			item := &items[i]
+			old := *item
+			cond, err := itemKeyCondition(tx, item)
+			if err != nil {
+				return err
+			}
+			columns, err := assignBulkValues(tx, entitySchema, item, values)
+			if err != nil {
+				return err
+			}
+			err = updateEntityWithHooks(tx, registered, &old, item, func() error {
+				result := write.Model(item).Where(cond).Select(columns).Updates(item)
+				affected += result.RowsAffected
+				return result.Error
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if query.returningIDs {
+			ids, err = primaryKeyStrings(tx, items)
+		}
+		return err
+	}))
+	if err != nil {
+		return 0, nil, err
+	}
+	return affected, ids, nil
+}
+
+// deleteEachWithHooks lock the items matching current filter, then delete them one by one between
+// their delete hooks
+func (query *SQLQuery[M, E]) deleteEachWithHooks(soft bool, registered []hooksEntry) (affected int64, ids []string, err error) {
+	err = dbError(query.db.Transaction(func(tx *gorm.DB) error {
+		if !soft {
+			tx = tx.Unscoped()
+		}
+		items, err := query.lockItems(tx)
+		if err != nil {
+			return err
+		}
+		if affected, err = deleteItemsWithHooks(tx, items, soft, registered); err != nil {
+			return err
+		}
+		if query.returningIDs {
+			ids, err = primaryKeyStrings(tx, items)
+		}
+		return err
+	}))
+	if err != nil {
+		return 0, nil, err
+	}
+	return affected, ids, nil
+}
+
+// deleteItemsWithHooks delete the loaded items one by one with tx between their delete hooks,
+// they are removed from database when soft is false
+//
+// It return number of deleted items
+func deleteItemsWithHooks[E any](tx *gorm.DB, items []E, soft bool, registered []hooksEntry) (affected int64, err error) {
+	write := tx.Session(&gorm.Session{NewDB: true})
+	if !soft {
+		write = write.Unscoped()
+	}
+	for i := range items {
+		item := &items[i]
+		cond, err := itemKeyCondition(tx, item)
+		if err != nil {
+			return affected, err
+		}
+		err = deleteWithHooks(tx, registered, item, func() error {
+			result := write.Where(cond).Delete(item)
+			affected += result.RowsAffected
+			return result.Error
+		})
+		if err != nil {
+			return affected, err
+		}
+	}
+	return affected, nil
+}
+
+// lockItems read the items matching current filter FOR UPDATE, with tx
+func (query *SQLQuery[M, E]) lockItems(tx *gorm.DB) ([]E, error) {
+	var items []E
+	db := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: clause.CurrentTable}})
+	if query.expressStr != "" {
+		db = db.Where(query.expressStr, query.args...)
+	}
+	err := db.Find(&items).Error
+	return items, err
+}
+
+// assignBulkValues set values on item like Updates, values is an entity whose non-empty fields are set,
+// or a map of column or field name to value. It return the columns to write
+func assignBulkValues[E any](db *gorm.DB, s *schema.Schema, item *E, values interface{}) ([]string, error) {
+	ctx := statementContext(db)
+	itemValue := reflect.ValueOf(item).Elem()
+	var columns []string
+	switch v := values.(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			field := s.LookUpField(name)
+			if field == nil || field.DBName == "" {
+				return nil, fmt.Errorf("%s has no column %s", s.Name, name)
+			}
+			if _, ok := value.(clause.Expression); ok {
+				return nil, fmt.Errorf("SQL expression for %s.%s is not supported with update hooks", s.Name, field.Name)
+			}
+			if err := field.Set(ctx, itemValue, value); err != nil {
+				return nil, fmt.Errorf("set %s.%s: %w", s.Name, field.Name, err)
+			}
+			columns = append(columns, field.DBName)
+		}
+	case E:
+		return assignBulkValues(db, s, item, &v)
+	case *E:
+		src := reflect.ValueOf(v).Elem()
+		for _, field := range s.Fields {
+			if field.DBName == "" || field.PrimaryKey || !field.Updatable {
+				continue
+			}
+			value, zero := field.ValueOf(ctx, src)
+			if zero {
+				continue
+			}
+			if err := field.Set(ctx, itemValue, value); err != nil {
+				return nil, err
+			}
+			columns = append(columns, field.DBName)
+		}
+	default:
+		return nil, fmt.Errorf("update values %T are not supported with update hooks", values)
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("no field to update")
+	}
+	for _, field := range s.Fields {
+		if field.AutoUpdateTime > 0 && field.DBName != "" {
+			columns = append(columns, field.DBName)
+		}
+	}
+	return columns, nil
+}
+
+// bulkDB check the filter guard and prepare the session for a bulk statement
+func (query *SQLQuery[M, E]) bulkDB() (*gorm.DB, error) {
+	db := query.db
+	if query.expressStr == "" {
+		if !query.allowUnfiltered {
+			return nil, ErrUnfiltered
+		}
+		db = db.Session(&gorm.Session{AllowGlobalUpdate: true})
+	}
+
+	if query.returningIDs {
+		fields, err := primaryKeyFields[E](db)
+		if err != nil {
+			return nil, err
+		}
+		columns := make([]clause.Column, len(fields))
+		for i, field := range fields {
+			columns[i] = clause.Column{Name: field.DBName}
+		}
+		db = db.Clauses(clause.Returning{Columns: columns})
+	}
+	return db, nil
+}
+
+// primaryKeyStrings read primary key values of items as strings,
+// the values of a composite key are joined with commas
+func primaryKeyStrings[E any](db *gorm.DB, items []E) ([]string, error) {
+	fields, err := primaryKeyFields[E](db)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(items))
+	for i := range items {
+		values := make([]string, len(fields))
+		for j, field := range fields {
+			value, _ := field.ValueOf(context.Background(), reflect.ValueOf(&items[i]).Elem())
+			values[j] = fmt.Sprint(value)
+		}
+		ids = append(ids, strings.Join(values, ","))
+	}
+	return ids, nil
+}
+
+// clearPrimaryKey set the primary key fields of item to their zero value
+func clearPrimaryKey[E any](db *gorm.DB, item *E) error {
+	fields, err := primaryKeyFields[E](db)
+	if err != nil {
+		return err
+	}
+	itemValue := reflect.ValueOf(item).Elem()
+	for _, field := range fields {
+		if err := field.Set(statementContext(db), itemValue, reflect.Zero(field.FieldType).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// CascadePolicy decide what happens to the items of a relation when their parent is deleted
+type CascadePolicy int
+
+const (
+	CascadeDelete   CascadePolicy = iota + 1 // delete (and restore) related items with their parent
+	CascadeRestrict                          // refuse to delete a parent which still has related items
+	CascadeSetNull                           // clear the foreign key of related items, it is not restored
+)
+
+// ErrRestricted is returned when a delete is refused by a CascadeRestrict relation
+var ErrRestricted = errors.New("delete restricted by related items")
+
+// CascadeReport is the number of affected rows per table of a cascading delete or restore
+type CascadeReport map[string]int64
+
+// maxCascadeDepth stop cascades looping on cyclic data
+const maxCascadeDepth = 32
+
+var (
+	cascadesMu sync.RWMutex
+	cascades   = map[reflect.Type]map[string]CascadePolicy{}
+)
+
+// RegisterCascade declare the policy of a has one or has many relation of entity E, relation is
+// the name of the relation field (e.g. "Tasks"). Once declared, DeleteItemByID, HardDeleteItemByID
+// and RestoreItemByID walk the relations of E inside one transaction
+func RegisterCascade[E any](relation string, policy CascadePolicy) {
+	entityType := reflect.TypeOf((*E)(nil)).Elem()
+
+	cascadesMu.Lock()
+	defer cascadesMu.Unlock()
+	if cascades[entityType] == nil {
+		cascades[entityType] = map[string]CascadePolicy{}
+	}
+	cascades[entityType][relation] = policy
+}
+
+// cascadePolicies return the relations declared for an entity type
+func cascadePolicies(entityType reflect.Type) map[string]CascadePolicy {
+	cascadesMu.RLock()
+	defer cascadesMu.RUnlock()
+	return cascades[entityType]
+}
+
+// DeleteItemByIDCascade delete an item by ID and walk its declared relations, in one transaction,
+// accepts generic types. Items are soft deleted when soft is true and their entity has a
+// gorm.DeletedAt field, all of them with the same deletion time so RestoreItemByIDCascade
+// restores exactly this delete; other items are removed from database
+//
+// It return affected rows per table, and ErrRestricted if a CascadeRestrict relation has items
+func DeleteItemByIDCascade[E any, K comparable](id K, soft bool) (CascadeReport, error) {
+	return DeleteItemByIDCascadeContext[E](context.Background(), id, soft)
+}
+
+// DeleteItemByIDCascadeContext is DeleteItemByIDCascade with a context
+func DeleteItemByIDCascadeContext[E any, K comparable](ctx context.Context, id K, soft bool) (CascadeReport, error) {
+	if !Connected {
+		return nil, ErrNotConnected
+	}
+	db := defaultDB.WithContext(ctx)
+	cond, err := primaryKeyCondition[E](db, id)
+	if err != nil {
+		return nil, err
+	}
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return nil, err
+	}
+
+	// With delete hooks or audit, the item is loaded first and its hooks run around the cascade
+	registered := deleteHooksFor[E]()
+	loaded := len(registered) > 0 || isAudited[E]()
+
+	var report CascadeReport
+	now := time.Now().Truncate(time.Microsecond) // precision of Postgres timestamps
+	conds := []clause.Expression{cond}
+	err = transaction(ctx, "DeleteItemByIDCascade", false, func(tx *gorm.DB) error {
+		report = CascadeReport{}
+		if loaded {
+			var item E
+			return deleteItemWithHooks(tx, cond, &item, registered, soft, report)
+		}
+		return cascadeDelete(tx, entitySchema, conds, soft, now, report, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// RestoreItemByIDCascade restore a soft deleted item by ID and the items deleted with it
+// through CascadeDelete relations, in one transaction, accepts generic types
+//
+// It return affected rows per table, and ErrNotFound if no soft deleted item has this ID
+func RestoreItemByIDCascade[E any, K comparable](id K) (CascadeReport, error) {
+	return RestoreItemByIDCascadeContext[E](context.Background(), id)
+}
+
+// RestoreItemByIDCascadeContext is RestoreItemByIDCascade with a context
+func RestoreItemByIDCascadeContext[E any, K comparable](ctx context.Context, id K) (CascadeReport, error) {
+	if !Connected {
+		return nil, ErrNotConnected
+	}
+	db := defaultDB.WithContext(ctx)
+	cond, err := primaryKeyCondition[E](db, id)
+	if err != nil {
+		return nil, err
+	}
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return nil, err
+	}
+	field, err := deletedAtField[E](db)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := updateHooksFor[E]()
+	loaded := len(registered) > 0 || isAudited[E]()
+
+	var report CascadeReport
+	err = transaction(ctx, "RestoreItemByIDCascade", false, func(tx *gorm.DB) error {
+		report = CascadeReport{}
+		if loaded {
+			return restoreItemWithHooks[E](tx, cond, registered, report)
+		}
+
+		// Children deleted with the item share its deletion time
+		var deletedAt *time.Time
+		if err := tx.Session(&gorm.Session{NewDB: true}).Table(entitySchema.Table).
+			Where(cond).Select(field.DBName).Scan(&deletedAt).Error; err != nil {
+			return err
+		}
+		if deletedAt == nil {
+			return dbError(gorm.ErrRecordNotFound)
+		}
+		return cascadeRestore(tx, entitySchema, []clause.Expression{cond}, *deletedAt, report, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// cascadeDelete apply the declared policies to the related items of the rows of s matching conds,
+// then delete these rows. Children are handled first, while conds still match their parents
+func cascadeDelete(tx *gorm.DB, s *schema.Schema, conds []clause.Expression, soft bool, now time.Time, report CascadeReport, depth int) error {
+	if depth > maxCascadeDepth {
+		return fmt.Errorf("cascade deeper than %d levels from %s", maxCascadeDepth, s.Table)
+	}
+	conds = conds[:len(conds):len(conds)] // appends must not write into the parent's conditions
+	deletedAt := softDeleteField(s)
+	if soft && deletedAt != nil {
+		conds = append(conds, clause.Expr{SQL: "? IS NULL", Vars: []interface{}{clause.Column{Table: clause.CurrentTable, Name: deletedAt.DBName}}})
+	}
+
+	for name, policy := range cascadePolicies(s.ModelType) {
+		rel, err := cascadeRelation(s, name)
+		if err != nil {
+			return err
+		}
+		childConds := relationConds(tx, s, rel, conds)
+		if childDeletedAt := softDeleteField(rel.FieldSchema); soft && childDeletedAt != nil {
+			// Children already in the trash are not affected by a soft delete, a hard delete
+			// must handle them too or the parent's rows are still referenced
+			childConds = append(childConds, clause.Expr{SQL: "? IS NULL", Vars: []interface{}{clause.Column{Table: clause.CurrentTable, Name: childDeletedAt.DBName}}})
+		}
+
+		var count int64
+		if err := tableDB(tx, rel.FieldSchema).Where(clause.And(childConds...)).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+
+		switch policy {
+		case CascadeRestrict:
+			return fmt.Errorf("%w: %s has %d items in %s", ErrRestricted, s.Table, count, rel.FieldSchema.Table)
+		case CascadeSetNull:
+			values := map[string]interface{}{}
+			for _, ref := range rel.References {
+				if ref.OwnPrimaryKey {
+					values[ref.ForeignKey.DBName] = nil
+				}
+			}
+			result := tableDB(tx, rel.FieldSchema).Where(clause.And(childConds...)).Updates(values)
+			if result.Error != nil {
+				return result.Error
+			}
+			report[rel.FieldSchema.Table] += result.RowsAffected
+		case CascadeDelete:
+			if err := cascadeDelete(tx, rel.FieldSchema, childConds, soft, now, report, depth+1); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown cascade policy %d for %s.%s", policy, s.Name, name)
+		}
+	}
+
+	var result *gorm.DB
+	if soft && deletedAt != nil {
+		result = tableDB(tx, s).Where(clause.And(conds...)).Update(deletedAt.DBName, now)
+	} else {
+		result = tableDB(tx, s).Where(clause.And(conds...)).Delete(reflect.New(s.ModelType).Interface())
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	report[s.Table] += result.RowsAffected
+	return nil
+}
+
+// cascadeRestore restore the rows of s matching conds deleted at deletedAt,
+// and the items deleted with them through CascadeDelete relations
+func cascadeRestore(tx *gorm.DB, s *schema.Schema, conds []clause.Expression, deletedAt time.Time, report CascadeReport, depth int) error {
+	if depth > maxCascadeDepth {
+		return fmt.Errorf("cascade deeper than %d levels from %s", maxCascadeDepth, s.Table)
+	}
+	field := softDeleteField(s)
+	if field == nil {
+		return nil
+	}
+	conds = append(conds[:len(conds):len(conds)], clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: deletedAt})
+
+	for name, policy := range cascadePolicies(s.ModelType) {
+		if policy != CascadeDelete {
+			continue
+		}
+		rel, err := cascadeRelation(s, name)
+		if err != nil {
+			return err
+		}
+		if err := cascadeRestore(tx, rel.FieldSchema, relationConds(tx, s, rel, conds), deletedAt, report, depth+1); err != nil {
+			return err
+		}
+	}
+
+	result := tableDB(tx, s).Where(clause.And(conds...)).Update(field.DBName, nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	report[s.Table] += result.RowsAffected
+	return nil
+}
+
+// hasCascades report whether relations were declared for entity E
+func hasCascades[E any]() bool {
+	return len(cascadePolicies(reflect.TypeOf((*E)(nil)).Elem())) > 0
+}
+
+// cascadeRelation find a declared relation in the schema
+func cascadeRelation(s *schema.Schema, name string) (*schema.Relationship, error) {
+	rel, ok := s.Relationships.Relations[name]
+	if !ok {
+		return nil, fmt.Errorf("%s has no relation %s", s.Name, name)
+	}
+	if rel.Type != schema.HasOne && rel.Type != schema.HasMany {
+		return nil, fmt.Errorf("cascade of %s.%s: only has one and has many relations are supported", s.Name, name)
+	}
+	return rel, nil
+}
+
+// relationConds build the conditions selecting the related items of the parent rows matching conds:
+// (foreign keys) IN (SELECT primary keys FROM parent WHERE conds)
+func relationConds(tx *gorm.DB, s *schema.Schema, rel *schema.Relationship, conds []clause.Expression) []clause.Expression {
+	var foreignKeys, primaryKeys []string
+	var childConds []clause.Expression
+	for _, ref := range rel.References {
+		if ref.OwnPrimaryKey {
+			foreignKeys = append(foreignKeys, tx.Statement.Quote(clause.Column{Table: rel.FieldSchema.Table, Name: ref.ForeignKey.DBName}))
+			primaryKeys = append(primaryKeys, tx.Statement.Quote(ref.PrimaryKey.DBName))
+		} else {
+			// Polymorphic type column
+			childConds = append(childConds, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: ref.ForeignKey.DBName}, Value: ref.PrimaryValue})
+		}
+	}
+	parents := tableDB(tx, s).Select(strings.Join(primaryKeys, ", ")).Where(clause.And(conds...))
+	return append(childConds, clause.Expr{
+		SQL:  fmt.Sprintf("(%s) IN (?)", strings.Join(foreignKeys, ", ")),
+		Vars: []interface{}{parents},
+	})
+}
+
+// tableDB start a statement on the table of s, without GORM's soft delete scope
+func tableDB(tx *gorm.DB, s *schema.Schema) *gorm.DB {
+	return tx.Session(&gorm.Session{NewDB: true}).Unscoped().Table(s.Table)
+}
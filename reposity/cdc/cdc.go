@@ -0,0 +1,486 @@
+// Package cdc stream the committed changes of chosen tables with Postgres logical replication
+// (pgoutput plugin), in commit order, including changes made outside this library.
+// The database must run with wal_level=logical and the user needs the REPLICATION attribute.
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"tudh-btc-studio.io/comongo/reposity"
+)
+
+// LSN is a position in the write-ahead log
+type LSN uint64
+
+// String format lsn like Postgres does, e.g. 16/B374D848
+func (lsn LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+// ParseLSN parse the textual form of a LSN
+func ParseLSN(s string) (LSN, error) {
+	high, low, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	h, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	l, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	return LSN(h<<32 | l), nil
+}
+
+// Change is a committed row change mapped to the dto (data transfer object) M.
+// Columns holding unchanged TOAST values (large values not modified by an update) are left empty
+type Change[M any] struct {
+	Op         reposity.ChangeOp // ChangeInsert, ChangeUpdate or ChangeDelete
+	Table      string
+	Old        *M        // deleted row, or old row of an update when its key changed. Only key columns are set unless the table has REPLICA IDENTITY FULL
+	New        *M        // inserted or updated row, nil for delete
+	LSN        LSN       // commit LSN of the transaction
+	CommitTime time.Time // commit time of the transaction
+}
+
+// CheckpointStore persist the position up to which changes were handled. After a restart
+// the reader resumes from it, so a change may be handled again but never skipped
+type CheckpointStore interface {
+	Load(ctx context.Context, slot string) (LSN, error) // return 0 when the slot has no checkpoint
+	Save(ctx context.Context, slot string, lsn LSN) error
+}
+
+// Checkpoint is a row of the checkpoint table used by TableCheckpointStore
+type Checkpoint struct {
+	Slot      string `gorm:"primaryKey"`
+	LSN       int64  `gorm:"column:lsn;not null"`
+	UpdatedAt time.Time
+}
+
+// TableName keep the checkpoint table next to the other tables of the schema
+func (Checkpoint) TableName() string {
+	return "cdc_checkpoint"
+}
+
+// TableCheckpointStore keep checkpoints in the cdc_checkpoint table
+type TableCheckpointStore struct {
+	DB *gorm.DB // default reposity.DB()
+}
+
+// Migrate create the checkpoint table
+func Migrate(db *gorm.DB) error {
+	if db == nil {
+		db = reposity.DB()
+	}
+	if db == nil {
+		return reposity.ErrNotConnected
+	}
+	return db.AutoMigrate(&Checkpoint{})
+}
+
+func (store TableCheckpointStore) db(ctx context.Context) (*gorm.DB, error) {
+	db := store.DB
+	if db == nil {
+		db = reposity.DB()
+	}
+	if db == nil {
+		return nil, reposity.ErrNotConnected
+	}
+	return db.WithContext(ctx), nil
+}
+
+func (store TableCheckpointStore) Load(ctx context.Context, slot string) (LSN, error) {
+	db, err := store.db(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var checkpoint Checkpoint
+	err = db.Where("slot = ?", slot).Take(&checkpoint).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return LSN(checkpoint.LSN), err
+}
+
+func (store TableCheckpointStore) Save(ctx context.Context, slot string, lsn LSN) error {
+	db, err := store.db(ctx)
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "slot"}},
+		DoUpdates: clause.AssignmentColumns([]string{"lsn", "updated_at"}),
+	}).Create(&Checkpoint{Slot: slot, LSN: int64(lsn)}).Error
+}
+
+// Options configure a Reader
+type Options struct {
+	Slot           string          // replication slot name, required
+	Publication    string          // publication name, default the slot name
+	Checkpoints    CheckpointStore // default TableCheckpointStore{}
+	StatusInterval time.Duration   // delay between standby status updates, default 10s
+	RetryInterval  time.Duration   // delay before Run reconnects after a failure, default 5s
+	OnError        func(error)     // called by Run when the stream fails
+	DSN            string          // connection string, default reposity.DSN()
+}
+
+// Reader decode the replication stream of a slot and dispatch changes to the handlers
+// registered with Register
+type Reader struct {
+	db        *gorm.DB
+	opts      Options
+	handlers  map[string]*tableHandler
+	relations map[uint32]*relation
+	typeMap   *pgtype.Map
+}
+
+// tableHandler map and dispatch the changes of one table
+type tableHandler struct {
+	table  string
+	handle func(ctx context.Context, op reposity.ChangeOp, rel *relation, oldRow, newRow []tupleColumn, tx *beginMessage) error
+}
+
+// New create a reader of the slot opts.Slot, db is used to manage the slot and publication
+// (nil use reposity.DB())
+func New(db *gorm.DB, opts Options) (*Reader, error) {
+	if db == nil {
+		db = reposity.DB()
+	}
+	if db == nil {
+		return nil, reposity.ErrNotConnected
+	}
+	if opts.Slot == "" {
+		return nil, errors.New("replication slot name is required")
+	}
+	if opts.Publication == "" {
+		opts.Publication = opts.Slot
+	}
+	if opts.Checkpoints == nil {
+		opts.Checkpoints = TableCheckpointStore{DB: db}
+	}
+	if opts.StatusInterval <= 0 {
+		opts.StatusInterval = 10 * time.Second
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 5 * time.Second
+	}
+	if opts.DSN == "" {
+		opts.DSN = reposity.DSN()
+	}
+	return &Reader{
+		db:        db,
+		opts:      opts,
+		handlers:  map[string]*tableHandler{},
+		relations: map[uint32]*relation{},
+		typeMap:   pgtype.NewMap(),
+	}, nil
+}
+
+// Register stream the changes of the table of entity E to handle, mapped into dto M, accepts generic types.
+// Register all tables before EnsurePublication and Run
+func Register[M any, E any](reader *Reader, handle func(ctx context.Context, change Change[M]) error) error {
+	var entity E
+	stmt := &gorm.Statement{DB: reader.db}
+	if err := stmt.Parse(&entity); err != nil {
+		return err
+	}
+	entitySchema := stmt.Schema
+
+	// Map a replicated row into M through the entity
+	mapRow := func(ctx context.Context, rel *relation, columns []tupleColumn) (*M, error) {
+		var item E
+		value := reflect.ValueOf(&item).Elem()
+		for i, column := range columns {
+			if i >= len(rel.Columns) || column.Kind != 't' {
+				continue
+			}
+			field := entitySchema.LookUpField(rel.Columns[i].Name)
+			if field == nil || field.DBName == "" {
+				continue
+			}
+			data, err := reader.decodeText(rel.Columns[i].OID, column.Text)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", field.DBName, err)
+			}
+			if err := field.Set(ctx, value, data); err != nil {
+				return nil, fmt.Errorf("column %s: %w", field.DBName, err)
+			}
+		}
+		var dto M
+		if err := reposity.MapToDTO(&dto, item); err != nil {
+			return nil, err
+		}
+		return &dto, nil
+	}
+
+	reader.handlers[entitySchema.Table] = &tableHandler{
+		table: entitySchema.Table,
+		handle: func(ctx context.Context, op reposity.ChangeOp, rel *relation, oldRow, newRow []tupleColumn, tx *beginMessage) error {
+			change := Change[M]{Op: op, Table: entitySchema.Table, LSN: tx.FinalLSN, CommitTime: tx.CommitTime}
+			var err error
+			if oldRow != nil {
+				if change.Old, err = mapRow(ctx, rel, oldRow); err != nil {
+					return err
+				}
+			}
+			if newRow != nil {
+				if change.New, err = mapRow(ctx, rel, newRow); err != nil {
+					return err
+				}
+			}
+			return handle(ctx, change)
+		},
+	}
+	return nil
+}
+
+// EnsureSlot create the replication slot if it does not exist. A slot retains WAL until its
+// changes are confirmed, drop it with DropSlot when the reader is retired
+func (reader *Reader) EnsureSlot(ctx context.Context) error {
+	db := reader.db.WithContext(ctx)
+	var exists bool
+	if err := db.Raw("SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = ?)", reader.opts.Slot).
+		Scan(&exists).Error; err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return db.Exec("SELECT pg_create_logical_replication_slot(?, 'pgoutput')", reader.opts.Slot).Error
+}
+
+// DropSlot drop the replication slot and its checkpoint
+func (reader *Reader) DropSlot(ctx context.Context) error {
+	db := reader.db.WithContext(ctx)
+	if err := db.Exec("SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = ?",
+		reader.opts.Slot).Error; err != nil {
+		return err
+	}
+	return reader.opts.Checkpoints.Save(ctx, reader.opts.Slot, 0)
+}
+
+// EnsurePublication create the publication, or reset its tables, to publish the registered tables
+func (reader *Reader) EnsurePublication(ctx context.Context) error {
+	if len(reader.handlers) == 0 {
+		return errors.New("no table registered")
+	}
+	db := reader.db.WithContext(ctx)
+	tables := make([]string, 0, len(reader.handlers))
+	for table := range reader.handlers {
+		tables = append(tables, db.Statement.Quote(table))
+	}
+
+	var exists bool
+	if err := db.Raw("SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = ?)", reader.opts.Publication).
+		Scan(&exists).Error; err != nil {
+		return err
+	}
+	action := "CREATE PUBLICATION %s FOR TABLE %s"
+	if exists {
+		action = "ALTER PUBLICATION %s SET TABLE %s"
+	}
+	return db.Exec(fmt.Sprintf(action, db.Statement.Quote(reader.opts.Publication), strings.Join(tables, ", "))).Error
+}
+
+// DropPublication drop the publication if it exists
+func (reader *Reader) DropPublication(ctx context.Context) error {
+	return reader.db.WithContext(ctx).
+		Exec(fmt.Sprintf("DROP PUBLICATION IF EXISTS %s", reader.db.Statement.Quote(reader.opts.Publication))).Error
+}
+
+// Run stream changes until ctx is canceled. When the stream or a handler fails, OnError is called
+// and the reader reconnects after RetryInterval, resuming from the last checkpoint
+func (reader *Reader) Run(ctx context.Context) {
+	for {
+		err := reader.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && reader.opts.OnError != nil {
+			reader.opts.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reader.opts.RetryInterval):
+		}
+	}
+}
+
+// stream open a replication connection and dispatch changes until it fails
+func (reader *Reader) stream(ctx context.Context) error {
+	checkpoint, err := reader.opts.Checkpoints.Load(ctx, reader.opts.Slot)
+	if err != nil {
+		return err
+	}
+
+	config, err := pgconn.ParseConfig(reader.opts.DSN)
+	if err != nil {
+		return err
+	}
+	config.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	// Relations are sent again by the server on each session
+	reader.relations = map[uint32]*relation{}
+
+	conn.Frontend().Send(&pgproto3.Query{String: fmt.Sprintf(
+		"START_REPLICATION SLOT %s LOGICAL %s (proto_version '1', publication_names '%s')",
+		pgIdentifier(reader.opts.Slot), checkpoint, strings.ReplaceAll(reader.opts.Publication, "'", "''"))})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		default:
+			continue
+		}
+		break
+	}
+
+	var tx *beginMessage
+	nextStatus := time.Now().Add(reader.opts.StatusInterval)
+	for {
+		if time.Now().After(nextStatus) {
+			if err := reader.sendStatus(conn, checkpoint, false); err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(reader.opts.StatusInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return err
+		}
+
+		var data []byte
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			data = msg.Data
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		default:
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case 'k': // primary keepalive: wal end, server time, reply requested
+			if len(data) >= 18 && data[17] == 1 {
+				if err := reader.sendStatus(conn, checkpoint, false); err != nil {
+					return err
+				}
+				nextStatus = time.Now().Add(reader.opts.StatusInterval)
+			}
+		case 'w': // XLogData: start, end, server time, then the pgoutput message
+			if len(data) < 25 {
+				return errors.New("pgoutput: short XLogData message")
+			}
+			message, err := decodeMessage(data[25:])
+			if err != nil {
+				return err
+			}
+			switch message := message.(type) {
+			case *relation:
+				reader.relations[message.ID] = message
+			case *beginMessage:
+				tx = message
+			case *commitMessage:
+				// Every change of the transaction was handled
+				if err := reader.opts.Checkpoints.Save(ctx, reader.opts.Slot, message.EndLSN); err != nil {
+					return err
+				}
+				checkpoint = message.EndLSN
+				tx = nil
+			case *insertMessage:
+				err = reader.dispatch(ctx, tx, message.RelationID, reposity.ChangeInsert, nil, message.New)
+			case *updateMessage:
+				err = reader.dispatch(ctx, tx, message.RelationID, reposity.ChangeUpdate, message.Old, message.New)
+			case *deleteMessage:
+				err = reader.dispatch(ctx, tx, message.RelationID, reposity.ChangeDelete, message.Old, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dispatch pass a row change to the handler of its table
+func (reader *Reader) dispatch(ctx context.Context, tx *beginMessage, relationID uint32, op reposity.ChangeOp, oldRow, newRow []tupleColumn) error {
+	rel, ok := reader.relations[relationID]
+	if !ok {
+		return fmt.Errorf("pgoutput: unknown relation %d", relationID)
+	}
+	if tx == nil {
+		return errors.New("pgoutput: change outside of a transaction")
+	}
+	handler, ok := reader.handlers[rel.Namespace+"."+rel.Name]
+	if !ok {
+		if handler, ok = reader.handlers[rel.Name]; !ok {
+			return nil
+		}
+	}
+	if err := handler.handle(ctx, op, rel, oldRow, newRow, tx); err != nil {
+		return fmt.Errorf("handle %s change of %s at %s: %w", op, handler.table, tx.FinalLSN, err)
+	}
+	return nil
+}
+
+// sendStatus confirm to the server that changes up to lsn are handled, so it can release the WAL
+func (reader *Reader) sendStatus(conn *pgconn.PgConn, lsn LSN, replyRequested bool) error {
+	conn.Frontend().Send(&pgproto3.CopyData{Data: standbyStatus(lsn, replyRequested)})
+	return conn.Frontend().Flush()
+}
+
+// decodeText convert a column in text format into a value accepted by schema.Field.Set:
+// time.Time for dates and timestamps, []byte for bytea and json, string otherwise
+func (reader *Reader) decodeText(oid uint32, text []byte) (interface{}, error) {
+	switch oid {
+	case pgtype.DateOID, pgtype.TimestampOID, pgtype.TimestamptzOID, pgtype.ByteaOID:
+		typ, ok := reader.typeMap.TypeForOID(oid)
+		if !ok {
+			return string(text), nil
+		}
+		return typ.Codec.DecodeValue(reader.typeMap, oid, pgtype.TextFormatCode, text)
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		return text, nil
+	}
+	return string(text), nil
+}
+
+// pgIdentifier quote a slot name for the replication protocol
+func pgIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,230 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// pgEpoch is the origin of the timestamps sent by the replication protocol
+var pgEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// relation describe a table, sent by pgoutput before the first change of the table in a session
+type relation struct {
+	ID        uint32
+	Namespace string
+	Name      string
+	Columns   []relationColumn
+}
+
+type relationColumn struct {
+	Key  bool // part of the replica identity
+	Name string
+	OID  uint32
+}
+
+// tupleColumn is a column value of a row. Text is nil for NULL and for unchanged TOAST values
+type tupleColumn struct {
+	Kind byte // 'n' null, 'u' unchanged TOAST, 't' text
+	Text []byte
+}
+
+// pgoutput messages handled by the reader, see "Logical Replication Message Formats"
+type (
+	beginMessage struct {
+		FinalLSN   LSN
+		CommitTime time.Time
+		Xid        uint32
+	}
+	commitMessage struct {
+		CommitLSN  LSN
+		EndLSN     LSN
+		CommitTime time.Time
+	}
+	insertMessage struct {
+		RelationID uint32
+		New        []tupleColumn
+	}
+	updateMessage struct {
+		RelationID uint32
+		Old        []tupleColumn // replica identity or full old row, nil if the key did not change
+		New        []tupleColumn
+	}
+	deleteMessage struct {
+		RelationID uint32
+		Old        []tupleColumn
+	}
+)
+
+// decoder read the big endian fields of a message
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) need(n int) bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.data) < n {
+		d.err = errors.New("pgoutput: message too short")
+		return false
+	}
+	return true
+}
+
+func (d *decoder) byte() byte {
+	if !d.need(1) {
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if !d.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.data)
+	d.data = d.data[2:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if !d.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if !d.need(8) {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return v
+}
+
+func (d *decoder) time() time.Time {
+	return pgTime(int64(d.uint64()))
+}
+
+func (d *decoder) string() string {
+	if d.err != nil {
+		return ""
+	}
+	for i, b := range d.data {
+		if b == 0 {
+			s := string(d.data[:i])
+			d.data = d.data[i+1:]
+			return s
+		}
+	}
+	d.err = errors.New("pgoutput: unterminated string")
+	return ""
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if !d.need(n) {
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) tuple() []tupleColumn {
+	columns := make([]tupleColumn, d.uint16())
+	for i := range columns {
+		columns[i].Kind = d.byte()
+		switch columns[i].Kind {
+		case 'n', 'u':
+		case 't':
+			columns[i].Text = d.bytes(int(d.uint32()))
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("pgoutput: unsupported tuple data kind %q", columns[i].Kind)
+			}
+		}
+	}
+	return columns
+}
+
+// decodeMessage decode a pgoutput (protocol version 1) message. Messages the reader
+// does not use (origin, type, truncate) are returned as nil
+func decodeMessage(data []byte) (interface{}, error) {
+	d := &decoder{data: data}
+	var message interface{}
+	switch d.byte() {
+	case 'B':
+		message = &beginMessage{FinalLSN: LSN(d.uint64()), CommitTime: d.time(), Xid: d.uint32()}
+	case 'C':
+		d.byte() // flags, unused
+		message = &commitMessage{CommitLSN: LSN(d.uint64()), EndLSN: LSN(d.uint64()), CommitTime: d.time()}
+	case 'R':
+		rel := &relation{ID: d.uint32(), Namespace: d.string(), Name: d.string()}
+		d.byte() // replica identity setting
+		rel.Columns = make([]relationColumn, d.uint16())
+		for i := range rel.Columns {
+			rel.Columns[i].Key = d.byte()&1 == 1
+			rel.Columns[i].Name = d.string()
+			rel.Columns[i].OID = d.uint32()
+			d.uint32() // type modifier
+		}
+		message = rel
+	case 'I':
+		insert := &insertMessage{RelationID: d.uint32()}
+		if kind := d.byte(); kind != 'N' && d.err == nil {
+			return nil, fmt.Errorf("pgoutput: unexpected insert tuple %q", kind)
+		}
+		insert.New = d.tuple()
+		message = insert
+	case 'U':
+		update := &updateMessage{RelationID: d.uint32()}
+		kind := d.byte()
+		if kind == 'K' || kind == 'O' {
+			update.Old = d.tuple()
+			kind = d.byte()
+		}
+		if kind != 'N' && d.err == nil {
+			return nil, fmt.Errorf("pgoutput: unexpected update tuple %q", kind)
+		}
+		update.New = d.tuple()
+		message = update
+	case 'D':
+		del := &deleteMessage{RelationID: d.uint32()}
+		if kind := d.byte(); kind != 'K' && kind != 'O' && d.err == nil {
+			return nil, fmt.Errorf("pgoutput: unexpected delete tuple %q", kind)
+		}
+		del.Old = d.tuple()
+		message = del
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return message, nil
+}
+
+// pgTime convert microseconds since 2000-01-01 to time
+func pgTime(micros int64) time.Time {
+	return pgEpoch.Add(time.Duration(micros) * time.Microsecond)
+}
+
+// standbyStatus encode a standby status update reporting lsn as written, flushed and applied
+func standbyStatus(lsn LSN, replyRequested bool) []byte {
+	data := make([]byte, 34)
+	data[0] = 'r'
+	binary.BigEndian.PutUint64(data[1:], uint64(lsn))
+	binary.BigEndian.PutUint64(data[9:], uint64(lsn))
+	binary.BigEndian.PutUint64(data[17:], uint64(lsn))
+	binary.BigEndian.PutUint64(data[25:], uint64(time.Since(pgEpoch).Microseconds()))
+	if replyRequested {
+		data[33] = 1
+	}
+	return data
+}
@@ -0,0 +1,145 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// message build a pgoutput message from bytes, strings (NUL terminated) and big endian integers
+func message(parts ...interface{}) []byte {
+	var data []byte
+	for _, part := range parts {
+		switch p := part.(type) {
+		case byte:
+			data = append(data, p)
+		case string:
+			data = append(append(data, p...), 0)
+		case []byte:
+			data = append(data, p...)
+		case uint16:
+			data = binary.BigEndian.AppendUint16(data, p)
+		case uint32:
+			data = binary.BigEndian.AppendUint32(data, p)
+		case uint64:
+			data = binary.BigEndian.AppendUint64(data, p)
+		default:
+			panic("unsupported message part")
+		}
+	}
+	return data
+}
+
+func TestDecodeMessage(t *testing.T) {
+	commitTime := pgEpoch.Add(90 * time.Second)
+	micros := uint64(90 * time.Second / time.Microsecond)
+
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{
+			name: "begin",
+			data: message(byte('B'), uint64(0x16B374D848), micros, uint32(742)),
+			want: &beginMessage{FinalLSN: 0x16B374D848, CommitTime: commitTime, Xid: 742},
+		},
+		{
+			name: "commit",
+			data: message(byte('C'), byte(0), uint64(10), uint64(20), micros),
+			want: &commitMessage{CommitLSN: 10, EndLSN: 20, CommitTime: commitTime},
+		},
+		{
+			name: "relation",
+			data: message(byte('R'), uint32(16385), "public", "users", byte('d'), uint16(2),
+				byte(1), "id", uint32(20), uint32(0xFFFFFFFF),
+				byte(0), "name", uint32(25), uint32(0xFFFFFFFF)),
+			want: &relation{ID: 16385, Namespace: "public", Name: "users", Columns: []relationColumn{
+				{Key: true, Name: "id", OID: 20},
+				{Name: "name", OID: 25},
+			}},
+		},
+		{
+			name: "insert",
+			data: message(byte('I'), uint32(16385), byte('N'), uint16(3),
+				byte('t'), uint32(1), []byte("7"), byte('n'), byte('t'), uint32(0)),
+			want: &insertMessage{RelationID: 16385, New: []tupleColumn{
+				{Kind: 't', Text: []byte("7")}, {Kind: 'n'}, {Kind: 't', Text: []byte{}},
+			}},
+		},
+		{
+			name: "update",
+			data: message(byte('U'), uint32(16385), byte('N'), uint16(2),
+				byte('t'), uint32(1), []byte("7"), byte('u')),
+			want: &updateMessage{RelationID: 16385, New: []tupleColumn{
+				{Kind: 't', Text: []byte("7")}, {Kind: 'u'},
+			}},
+		},
+		{
+			name: "update with old key",
+			data: message(byte('U'), uint32(16385),
+				byte('K'), uint16(1), byte('t'), uint32(1), []byte("7"),
+				byte('N'), uint16(1), byte('t'), uint32(1), []byte("8")),
+			want: &updateMessage{RelationID: 16385,
+				Old: []tupleColumn{{Kind: 't', Text: []byte("7")}},
+				New: []tupleColumn{{Kind: 't', Text: []byte("8")}},
+			},
+		},
+		{
+			name: "delete",
+			data: message(byte('D'), uint32(16385), byte('O'), uint16(1), byte('t'), uint32(1), []byte("7")),
+			want: &deleteMessage{RelationID: 16385, Old: []tupleColumn{{Kind: 't', Text: []byte("7")}}},
+		},
+		{
+			name: "truncate",
+			data: message(byte('T'), uint32(1), byte(0), uint32(16385)),
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeMessage(tt.data)
+			if err != nil {
+				t.Fatalf("decodeMessage: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeMessage = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated begin", message(byte('B'), uint64(1))},
+		{"unterminated string", message(byte('R'), uint32(1), []byte("public"))},
+		{"truncated tuple", message(byte('I'), uint32(1), byte('N'), uint16(1), byte('t'), uint32(5), []byte("ab"))},
+		{"unknown tuple kind", message(byte('I'), uint32(1), byte('N'), uint16(1), byte('b'))},
+		{"unexpected insert tuple", message(byte('I'), uint32(1), byte('K'), uint16(0))},
+		{"unexpected update tuple", message(byte('U'), uint32(1), byte('X'), uint16(0))},
+		{"unexpected delete tuple", message(byte('D'), uint32(1), byte('N'), uint16(0))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := decodeMessage(tt.data); err == nil {
+				t.Errorf("decodeMessage = %+v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestStandbyStatus(t *testing.T) {
+	data := standbyStatus(0x16B374D848, true)
+	if len(data) != 34 || data[0] != 'r' || data[33] != 1 {
+		t.Fatalf("standbyStatus = %v", data)
+	}
+	for _, offset := range []int{1, 9, 17} {
+		if lsn := binary.BigEndian.Uint64(data[offset:]); lsn != 0x16B374D848 {
+			t.Errorf("lsn at %d = %x", offset, lsn)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Command mapgen generate reflection-free reposity.Mapper implementations for pairs of dto
+// (data transfer object) and entity types declared in the same package, and register them
+// with reposity.RegisterMapper in an init function. Add to the package:
+//
+//	//go:generate go run tudh-btc-studio.io/comongo/reposity/cmd/mapgen -type UserDTO:User,TaskDTO:Task
+//
+// Fields are matched like the default mapper: by name, flattening embedded structs. Fields of the
+// same type are assigned, pointer and value fields are dereferenced or allocated, and other fields
+// go through reposity.MapValue. Types are compared after resolving the aliases declared in the
+// package (and byte, rune, any) and the import names, so `type Email = string` matches string
+// and `t.Time` matches `time.Time` when t imports "time". A pair embedding a struct declared in
+// another package (except gorm.Model) is mapped entirely with reposity.MapValue. Fields and pairs
+// falling back on reposity.MapValue are reported, they are slower and fail only at run time.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	typePairs = flag.String("type", "", "comma separated DTO:Entity type pairs, required")
+	output    = flag.String("output", "mapper_gen.go", "output file name")
+	dir       = flag.String("dir", ".", "package directory")
+)
+
+// gormModelFields are the fields of gorm.Model, which is embedded by most entities
+var gormModelFields = []field{
+	{Name: "ID", Type: "uint", Key: "uint"},
+	{Name: "CreatedAt", Type: "time.Time", Key: "time.Time"},
+	{Name: "UpdatedAt", Type: "time.Time", Key: "time.Time"},
+	{Name: "DeletedAt", Type: "gorm.DeletedAt", Key: "gorm.io/gorm.DeletedAt"},
+}
+
+// builtinAliases are the predeclared aliases
+var builtinAliases = map[string]string{"byte": "uint8", "rune": "int32", "any": "interface{}"}
+
+// field is a mapped field of a struct, Path is the selector from the struct value.
+// Type is the type as written, Key identify it: aliases resolved and packages by import path
+type field struct {
+	Name string
+	Path string
+	Type string
+	Key  string
+}
+
+// alias is a type alias declaration, with the imports of its file
+type alias struct {
+	target  ast.Expr
+	imports map[string]string
+}
+
+// pkg is the parsed package
+type pkg struct {
+	name     string
+	structs  map[string]*ast.StructType
+	aliases  map[string]alias
+	imports  map[*ast.StructType]map[string]string // local name -> import path, per declaring file
+	warnings []string
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mapgen: ")
+	flag.Parse()
+	if *typePairs == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, warnings, err := generate(*dir, *typePairs, *output)
+	for _, warning := range warnings {
+		log.Print(warning)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*dir, *output), src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate return the source of the mappers of pairs, comma separated DTO:Entity type pairs
+// declared in the package in dir, and the warnings about fields mapped with reposity.MapValue
+func generate(dir, pairs, output string) ([]byte, []string, error) {
+	p, err := parsePackage(dir, output)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body bytes.Buffer
+	var registrations []string
+	for _, pair := range strings.Split(pairs, ",") {
+		dtoName, entityName, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, p.warnings, fmt.Errorf("invalid type pair %q, want DTO:Entity", pair)
+		}
+		mapperName, err := generatePair(&body, p, dtoName, entityName)
+		if err != nil {
+			return nil, p.warnings, err
+		}
+		registrations = append(registrations, fmt.Sprintf("reposity.RegisterMapper[%s, %s](%s{})", dtoName, entityName, mapperName))
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by mapgen. DO NOT EDIT.\n\npackage %s\n\n", p.name)
+	fmt.Fprintf(&out, "import \"tudh-btc-studio.io/comongo/reposity\"\n\n")
+	fmt.Fprintf(&out, "func init() {\n\t%s\n}\n", strings.Join(registrations, "\n\t"))
+	out.Write(body.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, p.warnings, fmt.Errorf("format generated code: %w", err)
+	}
+	return src, p.warnings, nil
+}
+
+// parsePackage collect the struct types and aliases of the package in dir, skipping tests and the output file
+func parsePackage(dir, output string) (*pkg, error) {
+	fset := token.NewFileSet()
+	matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pkg{structs: map[string]*ast.StructType{}, aliases: map[string]alias{}, imports: map[*ast.StructType]map[string]string{}}
+	for _, path := range matches {
+		if strings.HasSuffix(path, "_test.go") || filepath.Base(path) == output {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		if p.name == "" {
+			p.name = file.Name.Name
+		}
+
+		imports := map[string]string{}
+		for _, spec := range file.Imports {
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			name := importPath[strings.LastIndex(importPath, "/")+1:]
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			imports[name] = importPath
+		}
+
+		ast.Inspect(file, func(node ast.Node) bool {
+			spec, ok := node.(*ast.TypeSpec)
+			if !ok {
+				return true
+			}
+			if spec.Assign.IsValid() {
+				p.aliases[spec.Name.Name] = alias{target: spec.Type, imports: imports}
+				return false
+			}
+			if structType, ok := spec.Type.(*ast.StructType); ok && spec.TypeParams == nil {
+				p.structs[spec.Name.Name] = structType
+				p.imports[structType] = imports
+			}
+			return false
+		})
+	}
+	if p.name == "" {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	return p, nil
+}
+
+// fields list the mapped fields of a struct: exported, not tagged `dto:"ignore"`, embedded structs
+// flattened with shallower fields hiding deeper ones. It return false if an embedded struct is unknown
+func (p *pkg) fields(structType *ast.StructType, path string) ([]field, bool) {
+	var fields, embedded []field
+	for _, f := range structType.Fields.List {
+		if f.Tag != nil {
+			tag, _ := strconv.Unquote(f.Tag.Value)
+			if value, ok := reflect.StructTag(tag).Lookup("dto"); ok && strings.Contains(value, "ignore") {
+				continue
+			}
+		}
+
+		// Embedded struct
+		if len(f.Names) == 0 {
+			switch t := f.Type.(type) {
+			case *ast.Ident:
+				inner, ok := p.structs[t.Name]
+				if !ok {
+					return nil, false
+				}
+				innerFields, ok := p.fields(inner, path+t.Name+".")
+				if !ok {
+					return nil, false
+				}
+				embedded = append(embedded, innerFields...)
+			case *ast.SelectorExpr:
+				pkgName, _ := t.X.(*ast.Ident)
+				if pkgName == nil || t.Sel.Name != "Model" || p.imports[structType][pkgName.Name] != "gorm.io/gorm" {
+					return nil, false
+				}
+				for _, modelField := range gormModelFields {
+					modelField.Path = path + "Model." + modelField.Name
+					embedded = append(embedded, modelField)
+				}
+			default:
+				return nil, false
+			}
+			continue
+		}
+
+		for _, name := range f.Names {
+			if name.IsExported() {
+				fields = append(fields, field{
+					Name: name.Name,
+					Path: path + name.Name,
+					Type: types.ExprString(f.Type),
+					Key:  p.typeKey(f.Type, p.imports[structType], 0),
+				})
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, f := range fields {
+		seen[f.Name] = true
+	}
+	for _, f := range embedded {
+		if !seen[f.Name] {
+			seen[f.Name] = true
+			fields = append(fields, f)
+		}
+	}
+	return fields, true
+}
+
+// generatePair write the mapper type of a pair and return its name
+func generatePair(w *bytes.Buffer, p *pkg, dtoName, entityName string) (string, error) {
+	dtoStruct, ok := p.structs[dtoName]
+	if !ok {
+		return "", fmt.Errorf("struct type %s not found", dtoName)
+	}
+	entityStruct, ok := p.structs[entityName]
+	if !ok {
+		return "", fmt.Errorf("struct type %s not found", entityName)
+	}
+
+	mapperName := lowerFirst(dtoName) + entityName + "Mapper"
+	fmt.Fprintf(w, "\n// %s map %s and %s without reflection\ntype %s struct{}\n", mapperName, dtoName, entityName, mapperName)
+
+	dtoFields, dtoOK := p.fields(dtoStruct, "")
+	entityFields, entityOK := p.fields(entityStruct, "")
+	if !dtoOK || !entityOK {
+		p.warnf("%s:%s embeds a struct of another package, falling back on reposity.MapValue", dtoName, entityName)
+		fmt.Fprintf(w, "\nfunc (%s) ToEntity(dst *%s, src %s) error {\n\treturn reposity.MapValue(dst, src)\n}\n", mapperName, entityName, dtoName)
+		fmt.Fprintf(w, "\nfunc (%s) ToDTO(dst *%s, src %s) error {\n\treturn reposity.MapValue(dst, src)\n}\n", mapperName, dtoName, entityName)
+		return mapperName, nil
+	}
+
+	fmt.Fprintf(w, "\nfunc (%s) ToEntity(dst *%s, src %s) error {\n", mapperName, entityName, dtoName)
+	p.writeFields(w, entityName, entityFields, dtoName, dtoFields)
+	fmt.Fprintf(w, "\treturn nil\n}\n")
+
+	fmt.Fprintf(w, "\nfunc (%s) ToDTO(dst *%s, src %s) error {\n", mapperName, dtoName, entityName)
+	p.writeFields(w, dtoName, dtoFields, entityName, entityFields)
+	fmt.Fprintf(w, "\treturn nil\n}\n")
+	return mapperName, nil
+}
+
+// writeFields write the statements mapping the src fields into the dst fields of the same name
+func (p *pkg) writeFields(w *bytes.Buffer, dstName string, dst []field, srcName string, src []field) {
+	srcFields := map[string]field{}
+	for _, f := range src {
+		srcFields[f.Name] = f
+	}
+
+	for _, d := range dst {
+		s, ok := srcFields[d.Name]
+		if !ok {
+			continue
+		}
+		switch {
+		case d.Key == s.Key:
+			fmt.Fprintf(w, "\tdst.%s = src.%s\n", d.Path, s.Path)
+		case s.Key == "*"+d.Key:
+			// Skip null pointers
+			fmt.Fprintf(w, "\tif src.%s != nil {\n\t\tdst.%s = *src.%s\n\t}\n", s.Path, d.Path, s.Path)
+		case d.Key == "*"+s.Key:
+			fmt.Fprintf(w, "\tif dst.%s == nil {\n\t\tv := src.%s\n\t\tdst.%s = &v\n\t} else {\n\t\t*dst.%s = src.%s\n\t}\n",
+				d.Path, s.Path, d.Path, d.Path, s.Path)
+		default:
+			p.warnf("%s.%s (%s) from %s.%s (%s) mapped with reposity.MapValue", dstName, d.Path, d.Type, srcName, s.Path, s.Type)
+			fmt.Fprintf(w, "\tif err := reposity.MapValue(&dst.%s, src.%s); err != nil {\n\t\treturn err\n\t}\n", d.Path, s.Path)
+		}
+	}
+}
+
+// typeKey identify the type expr of a file with imports: package aliases resolved,
+// packages named by import path
+func (p *pkg) typeKey(expr ast.Expr, imports map[string]string, depth int) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if target, ok := builtinAliases[t.Name]; ok {
+			return target
+		}
+		if a, ok := p.aliases[t.Name]; ok && depth < 16 {
+			return p.typeKey(a.target, a.imports, depth+1)
+		}
+		return t.Name
+	case *ast.SelectorExpr:
+		if pkgName, ok := t.X.(*ast.Ident); ok {
+			if importPath, ok := imports[pkgName.Name]; ok {
+				return importPath + "." + t.Sel.Name
+			}
+		}
+	case *ast.StarExpr:
+		return "*" + p.typeKey(t.X, imports, depth)
+	case *ast.ParenExpr:
+		return p.typeKey(t.X, imports, depth)
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return "[]" + p.typeKey(t.Elt, imports, depth)
+		}
+		return "[" + types.ExprString(t.Len) + "]" + p.typeKey(t.Elt, imports, depth)
+	case *ast.MapType:
+		return "map[" + p.typeKey(t.Key, imports, depth) + "]" + p.typeKey(t.Value, imports, depth)
+	case *ast.IndexExpr:
+		return p.typeKey(t.X, imports, depth) + "[" + p.typeKey(t.Index, imports, depth) + "]"
+	case *ast.IndexListExpr:
+		args := make([]string, len(t.Indices))
+		for i, index := range t.Indices {
+			args[i] = p.typeKey(index, imports, depth)
+		}
+		return p.typeKey(t.X, imports, depth) + "[" + strings.Join(args, ",") + "]"
+	}
+	return types.ExprString(expr)
+}
+
+// warnf record a warning about the generated code
+func (p *pkg) warnf(format string, args ...interface{}) {
+	p.warnings = append(p.warnings, fmt.Sprintf(format, args...))
+}
+
+func lowerFirst(s string) string {
+	runes := []rune(s)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func TestGenerateGolden(t *testing.T) {
+	tests := []struct {
+		dir      string
+		pairs    string
+		warnings []string
+	}{
+		{
+			dir:   "basic",
+			pairs: "UserDTO:User",
+		},
+		{
+			dir:   "types",
+			pairs: "OrderDTO:Order",
+			warnings: []string{
+				"Order.Status (Status) from OrderDTO.Status (string) mapped with reposity.MapValue",
+				"Order.Quantity (int) from OrderDTO.Quantity (string) mapped with reposity.MapValue",
+				"OrderDTO.Status (string) from Order.Status (Status) mapped with reposity.MapValue",
+				"OrderDTO.Quantity (string) from Order.Quantity (int) mapped with reposity.MapValue",
+			},
+		},
+		{
+			dir:      "foreign",
+			pairs:    "ProductDTO:Product",
+			warnings: []string{"ProductDTO:Product embeds a struct of another package, falling back on reposity.MapValue"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			dir := filepath.Join("testdata", tt.dir)
+			src, warnings, err := generate(dir, tt.pairs, "mapper_gen.go")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+
+			golden := filepath.Join(dir, "mapper_gen.golden")
+			if *update {
+				if err := os.WriteFile(golden, src, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(src) != string(want) {
+				t.Errorf("generated code differs from %s:\n%s", golden, src)
+			}
+		})
+	}
+}
+
+func TestGenerateUnknownType(t *testing.T) {
+	if _, _, err := generate(filepath.Join("testdata", "basic"), "MissingDTO:User", "mapper_gen.go"); err == nil {
+		t.Error("generate succeeded with an unknown type")
+	}
+}
@@ -0,0 +1,26 @@
+package basic
+
+import "gorm.io/gorm"
+
+type Audit struct {
+	CreatedBy string
+	UpdatedBy string
+}
+
+type User struct {
+	gorm.Model
+	Audit
+	Name     string
+	Email    *string
+	Age      int
+	Password string
+}
+
+type UserDTO struct {
+	ID        uint
+	Name      string
+	Email     string
+	Age       *int
+	CreatedBy string
+	Password  string `dto:"ignore"`
+}
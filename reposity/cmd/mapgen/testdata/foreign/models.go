@@ -0,0 +1,12 @@
+package foreign
+
+import "example.com/shared"
+
+type Product struct {
+	shared.Base
+	Name string
+}
+
+type ProductDTO struct {
+	Name string
+}
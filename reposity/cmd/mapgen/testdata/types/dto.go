@@ -0,0 +1,18 @@
+package types
+
+import (
+	t "time"
+
+	guuid "github.com/google/uuid"
+)
+
+type OrderDTO struct {
+	ID        guuid.UUID
+	Email     Email
+	Data      []byte
+	PlacedAt  Timestamp
+	Status    string
+	Quantity  string
+	Tags      map[Email]string
+	DeletedAt t.Time
+}
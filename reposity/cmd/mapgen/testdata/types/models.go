@@ -0,0 +1,24 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Email = string
+
+type Timestamp = time.Time
+
+type Status string
+
+type Order struct {
+	ID        uuid.UUID
+	Email     string
+	Data      []uint8
+	PlacedAt  time.Time
+	Status    Status
+	Quantity  int
+	Tags      map[string]string
+	DeletedAt *time.Time
+}
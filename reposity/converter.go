@@ -0,0 +1,231 @@
+package reposity
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Converters is a registry of conversion functions used by the default mapper for type pairs
+// it can not map by itself, or maps differently than wanted: enums stored as strings, times
+// exposed as epochs, decimal types... A registry created with NewConverters falls back on the
+// global one, which RegisterConverter fills
+type Converters struct {
+	parent *Converters
+	mu     sync.RWMutex
+	funcs  map[planKey]mapFunc
+	cache  atomic.Pointer[planCache]
+}
+
+// converterGeneration change whenever a converter is added, so compiled plans are rebuilt
+var converterGeneration atomic.Uint64
+
+// defaultConverters is the global registry, empty until RegisterConverter is called
+var defaultConverters = &Converters{funcs: map[planKey]mapFunc{}}
+
+// NewConverters create a registry for a repository, see NewMapper
+func NewConverters() *Converters {
+	return &Converters{parent: defaultConverters, funcs: map[planKey]mapFunc{}}
+}
+
+// RegisterConverter add a global conversion from From to To, used when mapping in both
+// directions between dtos and entities (register the reverse conversion too).
+// Pointers and nullable values around From and To are handled by the mapper
+func RegisterConverter[From any, To any](fn func(From) (To, error)) {
+	AddConverter(defaultConverters, fn)
+}
+
+// AddConverter add a conversion from From to To to a registry
+func AddConverter[From any, To any](converters *Converters, fn func(From) (To, error)) {
+	key := planKey{dst: reflect.TypeOf((*To)(nil)).Elem(), src: reflect.TypeOf((*From)(nil)).Elem()}
+
+	converters.mu.Lock()
+	converters.funcs[key] = func(dst, src reflect.Value) error {
+		value, err := fn(src.Interface().(From))
+		if err != nil {
+			return fmt.Errorf("convert %v to %v: %w", key.src, key.dst, err)
+		}
+		dst.Set(reflect.ValueOf(&value).Elem())
+		return nil
+	}
+	converters.mu.Unlock()
+	converterGeneration.Add(1)
+}
+
+// lookup find the converter of a type pair in the registry, then in its parent
+func (converters *Converters) lookup(key planKey) (mapFunc, bool) {
+	for c := converters; c != nil; c = c.parent {
+		c.mu.RLock()
+		convert, ok := c.funcs[key]
+		c.mu.RUnlock()
+		if ok {
+			return convert, true
+		}
+	}
+	return nil, false
+}
+
+// planCache return the plans compiled with the current converters
+func (converters *Converters) planCache() *planCache {
+	generation := converterGeneration.Load()
+	cache := converters.cache.Load()
+	if cache == nil || cache.generation != generation {
+		cache = &planCache{converters: converters, generation: generation, compiling: map[planKey]*mapFunc{}}
+		converters.cache.Store(cache)
+	}
+	return cache
+}
+
+// TimeToString format a time as RFC 3339, the zero time gives an empty string.
+// Register it with StringToTime to expose times as strings
+func TimeToString(t time.Time) (string, error) {
+	if t.IsZero() {
+		return "", nil
+	}
+	return t.Format(time.RFC3339Nano), nil
+}
+
+// StringToTime parse a RFC 3339 time, an empty string gives the zero time, the reverse of TimeToString
+func StringToTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// TimeToUnix convert a time to Unix seconds, register it to expose times as epochs
+func TimeToUnix(t time.Time) (int64, error) {
+	return t.Unix(), nil
+}
+
+// UnixToTime convert Unix seconds to a time, the reverse of TimeToUnix
+func UnixToTime(seconds int64) (time.Time, error) {
+	return time.Unix(seconds, 0), nil
+}
+
+var (
+	valuerType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// driverValuePlan map values of database types (driver.Valuer) into plain values, and plain values
+// into database types (sql.Scanner), e.g. pgtype.Numeric to float64 or string to a JSON column type.
+// Struct to struct pairs are left to the field plans
+func (cache *planCache) driverValuePlan(dst, src reflect.Type) (mapFunc, bool) {
+	srcValuer := src.Implements(valuerType)
+	dstScanner := reflect.PointerTo(dst).Implements(scannerType)
+
+	switch {
+	case srcValuer && (dstScanner || !isPlainStruct(dst)):
+		return func(dstValue, srcValue reflect.Value) error {
+			value, err := srcValue.Interface().(driver.Valuer).Value()
+			if err != nil {
+				return err
+			}
+			if value == nil {
+				return nil
+			}
+			if dstScanner {
+				return dstValue.Addr().Interface().(sql.Scanner).Scan(value)
+			}
+			return cache.assignDriverValue(dstValue, value)
+		}, true
+
+	case dstScanner && !srcValuer && !isPlainStruct(src):
+		return func(dstValue, srcValue reflect.Value) error {
+			scanner := dstValue.Addr().Interface().(sql.Scanner)
+			err := scanner.Scan(srcValue.Interface())
+			if err != nil && isNumber(src) {
+				// Some numeric types only scan text, like pgtype.Numeric
+				if scanner.Scan(fmt.Sprint(srcValue.Interface())) == nil {
+					return nil
+				}
+			}
+			return err
+		}, true
+	}
+	return nil, false
+}
+
+// assignDriverValue set a value returned by driver.Valuer into dst, parsing numbers and
+// booleans returned as text
+func (cache *planCache) assignDriverValue(dst reflect.Value, value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return cache.plan(dst.Type(), reflect.TypeOf(value))(dst, reflect.ValueOf(value))
+	}
+
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(text, 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(text, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		dst.SetBool(b)
+	default:
+		return cache.plan(dst.Type(), reflect.TypeOf(value))(dst, reflect.ValueOf(value))
+	}
+	return nil
+}
+
+// isNullPlan return a function reporting whether a src value is null, for nullable and
+// driver.Valuer types, so a destination pointer is not allocated for a null value
+func isNullPlan(src reflect.Type) func(reflect.Value) bool {
+	if src.Implements(valuerType) {
+		return func(srcValue reflect.Value) bool {
+			value, err := srcValue.Interface().(driver.Valuer).Value()
+			return err == nil && value == nil
+		}
+	}
+	if valueIndex, ok := nullableValue(src); ok {
+		return func(srcValue reflect.Value) bool {
+			return !srcValue.Field(1 - valueIndex).Bool()
+		}
+	}
+	return nil
+}
+
+// isNumber report whether t is an integer or float type
+func isNumber(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// isPlainStruct report whether t is a struct mapped field by field
+func isPlainStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType
+}
@@ -0,0 +1,159 @@
+package reposity
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Errors returned by the helpers, mapped from PostgreSQL error codes (SQLSTATE). They wrap the
+// original error, so gorm.ErrRecordNotFound or *pgconn.PgError stay reachable with errors.Is/As
+var (
+	// ErrNotConnected is returned when a helper is called before Connect
+	ErrNotConnected = errors.New("database not connected")
+	// ErrNotFound is returned when the item does not exist (gorm.ErrRecordNotFound)
+	ErrNotFound = errors.New("item not found")
+	// ErrConflict is returned when a unique constraint is violated (SQLSTATE 23505), see ConstraintError
+	ErrConflict = errors.New("conflict")
+	// ErrForeignKey is returned when a foreign key constraint is violated (SQLSTATE 23503), see ConstraintError
+	ErrForeignKey = errors.New("foreign key violation")
+	// ErrCheckViolation is returned when a check constraint is violated (SQLSTATE 23514), see ConstraintError
+	ErrCheckViolation = errors.New("check constraint violation")
+	// ErrNotNull is returned when a NOT NULL column is set to null (SQLSTATE 23502), see ConstraintError
+	ErrNotNull = errors.New("not null violation")
+	// ErrSerialization is returned when a serializable transaction conflicts with another one (SQLSTATE 40001)
+	ErrSerialization = errors.New("serialization failure")
+	// ErrDeadlock is returned when the transaction was aborted to break a deadlock (SQLSTATE 40P01)
+	ErrDeadlock = errors.New("deadlock detected")
+	// ErrLockNotAvailable is returned when a NOWAIT read finds a locked row (SQLSTATE 55P03)
+	ErrLockNotAvailable = errors.New("lock not available")
+	// ErrTimeout is returned when a statement timed out (SQLSTATE 57014) or its context deadline passed
+	ErrTimeout = errors.New("timeout")
+)
+
+// ConstraintError is returned when a statement violates a constraint, Kind is ErrConflict, ErrForeignKey,
+// ErrCheckViolation or ErrNotNull, so errors.Is(err, ErrConflict) match it
+type ConstraintError struct {
+	Kind       error
+	Constraint string   // constraint name, empty for not null violations
+	Table      string   // table of the constraint
+	Columns    []string // columns of the violated key, or the not null column
+	Err        *pgconn.PgError
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable report whether err is a conflict with another transaction that can succeed if the
+// transaction is retried: deadlock or serialization failure. ErrLockNotAvailable is not, a NOWAIT
+// read asked to fail instead of waiting for the lock
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrDeadlock) || errors.Is(err, ErrSerialization)
+}
+
+// keyColumnsPattern match the columns of the key in the detail of unique and foreign key
+// violations: Key (tenant_id, code)=(1, abc) already exists.
+var keyColumnsPattern = regexp.MustCompile(`^Key \((.+?)\)=`)
+
+// dbError wrap errors of GORM and Postgres into the errors above, other errors are returned as is
+func dbError(err error) error {
+	if err == nil || isMapped(err) {
+		return err
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		if pgconn.Timeout(err) {
+			return fmt.Errorf("%w: %w", ErrTimeout, err)
+		}
+		return err
+	}
+
+	switch pgErr.Code {
+	case "23505":
+		return constraintError(ErrConflict, pgErr)
+	case "23503":
+		return constraintError(ErrForeignKey, pgErr)
+	case "23514":
+		return constraintError(ErrCheckViolation, pgErr)
+	case "23502":
+		return constraintError(ErrNotNull, pgErr)
+	case "40001":
+		return fmt.Errorf("%w: %w", ErrSerialization, err)
+	case "40P01":
+		return fmt.Errorf("%w: %w", ErrDeadlock, err)
+	case "55P03":
+		return fmt.Errorf("%w: %w", ErrLockNotAvailable, err)
+	case "57014":
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// isMapped report whether err was already wrapped by dbError
+func isMapped(err error) bool {
+	for _, target := range []error{ErrNotConnected, ErrNotFound, ErrConflict, ErrForeignKey, ErrCheckViolation,
+		ErrNotNull, ErrSerialization, ErrDeadlock, ErrLockNotAvailable, ErrTimeout} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// constraintError build the ConstraintError of a constraint violation
+func constraintError(kind error, pgErr *pgconn.PgError) *ConstraintError {
+	e := &ConstraintError{Kind: kind, Constraint: pgErr.ConstraintName, Table: pgErr.TableName, Err: pgErr}
+	if pgErr.ColumnName != "" {
+		e.Columns = []string{pgErr.ColumnName}
+	} else if match := keyColumnsPattern.FindStringSubmatch(pgErr.Detail); match != nil {
+		for _, column := range strings.Split(match[1], ", ") {
+			if unquoted, err := strconv.Unquote(column); err == nil {
+				column = unquoted
+			}
+			e.Columns = append(e.Columns, column)
+		}
+	}
+	return e
+}
+
+// registerErrorCallbacks map the errors of every statement run with db, including those of
+// callers using DB() directly
+func registerErrorCallbacks(db *gorm.DB) error {
+	mapError := func(tx *gorm.DB) {
+		if tx.Error != nil {
+			tx.Error = dbError(tx.Error)
+		}
+	}
+	callbacks := db.Callback()
+	for _, register := range []func(string, func(*gorm.DB)) error{
+		callbacks.Create().After("*").Register,
+		callbacks.Query().After("*").Register,
+		callbacks.Update().After("*").Register,
+		callbacks.Delete().After("*").Register,
+		callbacks.Row().After("*").Register,
+		callbacks.Raw().After("*").Register,
+	} {
+		if err := register("reposity:errors", mapError); err != nil {
+			return err
+		}
+	}
+	return nil
+}
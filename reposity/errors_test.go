@@ -0,0 +1,103 @@
+package reposity
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+func TestDBError(t *testing.T) {
+	unknown := errors.New("something else")
+	tests := []struct {
+		name        string
+		err         error
+		want        error // sentinel matched with errors.Is, nil for pass-through
+		wantColumns []string
+	}{
+		{
+			name: "unique",
+			err: &pgconn.PgError{Code: "23505", ConstraintName: "idx_users_tenant_code", TableName: "users",
+				Detail: `Key (tenant_id, code)=(1, abc) already exists.`},
+			want:        ErrConflict,
+			wantColumns: []string{"tenant_id", "code"},
+		},
+		{
+			name: "foreign key",
+			err: &pgconn.PgError{Code: "23503", ConstraintName: "fk_tasks_project", TableName: "tasks",
+				Detail: `Key ("project_id")=(7) is not present in table "projects".`},
+			want:        ErrForeignKey,
+			wantColumns: []string{"project_id"},
+		},
+		{
+			name:        "not null",
+			err:         &pgconn.PgError{Code: "23502", TableName: "users", ColumnName: "email"},
+			want:        ErrNotNull,
+			wantColumns: []string{"email"},
+		},
+		{
+			name: "check",
+			err:  &pgconn.PgError{Code: "23514", ConstraintName: "chk_users_age", TableName: "users"},
+			want: ErrCheckViolation,
+		},
+		{name: "serialization", err: &pgconn.PgError{Code: "40001"}, want: ErrSerialization},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}, want: ErrDeadlock},
+		{name: "lock not available", err: &pgconn.PgError{Code: "55P03"}, want: ErrLockNotAvailable},
+		{name: "statement timeout", err: &pgconn.PgError{Code: "57014"}, want: ErrTimeout},
+		{name: "not found", err: gorm.ErrRecordNotFound, want: ErrNotFound},
+		{name: "wrapped", err: fmt.Errorf("query: %w", &pgconn.PgError{Code: "40P01"}), want: ErrDeadlock},
+		{name: "unknown code", err: &pgconn.PgError{Code: "42P01"}},
+		{name: "unknown error", err: unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dbError(tt.err)
+			if tt.want == nil {
+				if got != tt.err {
+					t.Fatalf("dbError(%v) = %v, want it unchanged", tt.err, got)
+				}
+				return
+			}
+			if !errors.Is(got, tt.want) {
+				t.Fatalf("dbError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+			if !errors.Is(got, tt.err) {
+				t.Errorf("dbError(%v) = %v, original error is not wrapped", tt.err, got)
+			}
+			if dbError(got) != got {
+				t.Errorf("dbError is not idempotent on %v", got)
+			}
+
+			var pgErr *pgconn.PgError
+			var constraintErr *ConstraintError
+			if errors.As(tt.err, &pgErr) && pgErr.Code[:2] == "23" {
+				if !errors.As(got, &constraintErr) {
+					t.Fatalf("dbError(%v) = %T, want *ConstraintError", tt.err, got)
+				}
+				if constraintErr.Constraint != pgErr.ConstraintName || constraintErr.Table != pgErr.TableName {
+					t.Errorf("constraint = %q on %q, want %q on %q", constraintErr.Constraint, constraintErr.Table, pgErr.ConstraintName, pgErr.TableName)
+				}
+				if !reflect.DeepEqual(constraintErr.Columns, tt.wantColumns) {
+					t.Errorf("columns = %q, want %q", constraintErr.Columns, tt.wantColumns)
+				}
+			} else if errors.As(got, &constraintErr) {
+				t.Errorf("dbError(%v) is a *ConstraintError", tt.err)
+			}
+		})
+	}
+
+	if dbError(nil) != nil {
+		t.Error("dbError(nil) is not nil")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for code, want := range map[string]bool{"40001": true, "40P01": true, "55P03": false, "23505": false} {
+		if got := IsRetryable(dbError(&pgconn.PgError{Code: code})); got != want {
+			t.Errorf("IsRetryable(%s) = %v, want %v", code, got, want)
+		}
+	}
+}
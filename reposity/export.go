@@ -0,0 +1,430 @@
+package reposity
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DataFormat is the tabular format used to export and import items
+type DataFormat string
+
+const (
+	// FormatCSV is RFC 4180 comma separated values
+	FormatCSV DataFormat = "csv"
+	// FormatNDJSON is newline delimited JSON, one object per line
+	FormatNDJSON DataFormat = "ndjson"
+)
+
+// utf8BOM is written before CSV output when ExportOptions.WriteBOM is set,
+// so spreadsheet applications detect the encoding
+const utf8BOM = "\ufeff"
+
+// ExportOptions configure the output of Export. The zero value writes comma separated
+// CSV with a header row, RFC 3339 times and shortest float representation
+type ExportOptions struct {
+	Delimiter      rune   // CSV field delimiter, default ','
+	WriteBOM       bool   // prefix CSV output with an UTF-8 byte order mark
+	UseCRLF        bool   // terminate CSV lines with \r\n
+	NoHeader       bool   // omit the CSV header row
+	TimeLayout     string // layout for time values, default time.RFC3339
+	FloatFormat    byte   // strconv format for floats ('f', 'e', 'g'), default shortest 'f'
+	FloatPrecision int    // precision for floats, only used when FloatFormat is set
+	Sort           string // sort param as for ExecNoPaging ("-field", "+field")
+	FetchSize      int    // rows fetched per round trip, default DefaultFetchSize
+	// UseCopy stream CSV with Postgres COPY ... TO STDOUT when the query allows it.
+	// Values are then formatted by the database, TimeLayout and float options are ignored
+	UseCopy bool
+}
+
+// Export run the query with current filter and write all items into w,
+// columns are DTO field names (tag or Go name), all fields if empty.
+// Column headers and JSON keys come from the `csv` or `json` tags of the DTO
+func (query *SQLQuery[M, E]) Export(ctx context.Context, w io.Writer, format DataFormat, columns []string, opts ...ExportOptions) error {
+	if !Connected {
+		return ErrNotConnected
+	}
+
+	var opt ExportOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Delimiter == 0 {
+		opt.Delimiter = ','
+	}
+	if opt.TimeLayout == "" {
+		opt.TimeLayout = time.RFC3339
+	}
+
+	var dto M
+	fields, err := selectDTOFields(reflect.TypeOf(dto), columns)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatCSV:
+		if opt.UseCopy {
+			copied, err := query.exportCopy(ctx, w, fields, opt)
+			if copied || err != nil {
+				return err
+			}
+		}
+		return query.exportCSV(ctx, w, fields, opt)
+	case FormatNDJSON:
+		return query.exportNDJSON(ctx, w, fields, opt)
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+// exportCSV write the header then stream items row by row as CSV
+func (query *SQLQuery[M, E]) exportCSV(ctx context.Context, w io.Writer, fields []dtoField, opt ExportOptions) error {
+	if opt.WriteBOM {
+		if _, err := io.WriteString(w, utf8BOM); err != nil {
+			return err
+		}
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Comma = opt.Delimiter
+	writer.UseCRLF = opt.UseCRLF
+
+	record := make([]string, len(fields))
+	if !opt.NoHeader {
+		for i, f := range fields {
+			record[i] = f.Key
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	for dto, err := range query.StreamNoPaging(ctx, opt.Sort, opt.FetchSize) {
+		if err != nil {
+			return err
+		}
+		v := reflect.ValueOf(dto)
+		for i, f := range fields {
+			if record[i], err = formatExportValue(v.FieldByIndex(f.Index), opt); err != nil {
+				return err
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportNDJSON stream items as one JSON object per line, keys in column order
+func (query *SQLQuery[M, E]) exportNDJSON(ctx context.Context, w io.Writer, fields []dtoField, opt ExportOptions) error {
+	buf := bufio.NewWriter(w)
+
+	for dto, err := range query.StreamNoPaging(ctx, opt.Sort, opt.FetchSize) {
+		if err != nil {
+			return err
+		}
+		v := reflect.ValueOf(dto)
+		buf.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(f.Key)
+			buf.Write(key)
+			buf.WriteByte(':')
+
+			value, err := marshalExportValue(v.FieldByIndex(f.Index), opt)
+			if err != nil {
+				return err
+			}
+			buf.Write(value)
+		}
+		buf.WriteString("}\n")
+	}
+
+	return buf.Flush()
+}
+
+// formatExportValue format a DTO field value as a CSV cell, nil is written as empty cell
+func formatExportValue(v reflect.Value, opt ExportOptions) (string, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	switch t := v.Interface().(type) {
+	case time.Time:
+		return t.Format(opt.TimeLayout), nil
+	case []byte:
+		return string(t), nil
+	case driver.Valuer:
+		value, err := t.Value()
+		if err != nil || value == nil {
+			return "", err
+		}
+		return formatExportValue(reflect.ValueOf(value), opt)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return formatExportFloat(v.Float(), v.Type().Bits(), opt), nil
+	default:
+		// Structs, maps and slices are written as JSON
+		b, err := json.Marshal(v.Interface())
+		return string(b), err
+	}
+}
+
+// marshalExportValue encode a DTO field value as JSON, applying time and float options
+func marshalExportValue(v reflect.Value, opt ExportOptions) ([]byte, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return []byte("null"), nil
+		}
+		v = v.Elem()
+	}
+
+	if t, ok := v.Interface().(time.Time); ok {
+		return json.Marshal(t.Format(opt.TimeLayout))
+	}
+	if (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64) && opt.FloatFormat != 0 {
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return []byte("null"), nil
+		}
+		return []byte(formatExportFloat(f, v.Type().Bits(), opt)), nil
+	}
+	return json.Marshal(v.Interface())
+}
+
+func formatExportFloat(f float64, bitSize int, opt ExportOptions) string {
+	if opt.FloatFormat == 0 {
+		return strconv.FormatFloat(f, 'f', -1, bitSize)
+	}
+	return strconv.FormatFloat(f, opt.FloatFormat, opt.FloatPrecision, bitSize)
+}
+
+// exportCopy stream the filtered query with COPY ... TO STDOUT. COPY does not accept bind
+// parameters, so it is only used when every argument can be inlined as a literal and the query
+// runs on the default pool (not inside a transaction).
+//
+// It return false without error when COPY is not possible and the caller should fall back to streaming
+func (query *SQLQuery[M, E]) exportCopy(ctx context.Context, w io.Writer, fields []dtoField, opt ExportOptions) (bool, error) {
+	if _, ok := query.db.Statement.ConnPool.(gorm.TxCommitter); ok {
+		return false, nil
+	}
+	entitySchema, err := parseEntitySchema[E](query.db)
+	if err != nil {
+		return false, err
+	}
+
+	// Resolve DTO fields to entity columns
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		field := entitySchema.LookUpField(f.Name)
+		if field == nil || field.DBName == "" {
+			return false, nil
+		}
+		columns[i] = field.DBName
+	}
+
+	selectSQL, ok, err := query.copySelectSQL(columns, opt.Sort)
+	if !ok || err != nil {
+		return false, err
+	}
+
+	sqlDB, err := query.db.DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// COPY writes \n line endings, converted like csv.Writer does with UseCRLF
+	if opt.UseCRLF {
+		w = crlfWriter{w: w}
+	}
+
+	copied := false
+	err = conn.Raw(func(driverConn any) error {
+		stdConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return nil
+		}
+		pgConn := stdConn.Conn().PgConn()
+		if pgConn.ParameterStatus("standard_conforming_strings") != "on" {
+			return nil
+		}
+
+		if opt.WriteBOM {
+			if _, err := io.WriteString(w, utf8BOM); err != nil {
+				return err
+			}
+		}
+		if !opt.NoHeader {
+			writer := csv.NewWriter(w)
+			writer.Comma = opt.Delimiter
+			header := make([]string, len(fields))
+			for i, f := range fields {
+				header[i] = f.Key
+			}
+			if err := writer.Write(header); err != nil {
+				return err
+			}
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				return err
+			}
+		}
+
+		copied = true
+		copySQL := fmt.Sprintf("COPY (%s) TO STDOUT WITH (FORMAT csv, DELIMITER %s)",
+			selectSQL, quoteLiteral(string(opt.Delimiter)))
+		_, err := pgConn.CopyTo(ctx, w, copySQL)
+		return err
+	})
+	return copied, err
+}
+
+// copySelectSQL build the SELECT of exportCopy with the filter arguments written as literals.
+// They are inlined while GORM builds the statement, so no placeholder is left to substitute
+// and quoted text of the filter is kept as is.
+//
+// It return false if an argument can not be written safely as a literal, or if the query
+// has other bind parameters (e.g. from scopes)
+func (query *SQLQuery[M, E]) copySelectSQL(columns []string, sort string) (string, bool, error) {
+	args, ok := inlineSQLVars(query.args)
+	if !ok {
+		return "", false, nil
+	}
+
+	var items []E
+	stmt := query.db.Session(&gorm.Session{DryRun: true}).Select(columns).Order(orderClause(sort)).
+		Where(query.expressStr, args...).Find(&items).Statement
+	if stmt.Error != nil {
+		return "", false, stmt.Error
+	}
+	if len(stmt.Vars) > 0 {
+		return "", false, nil
+	}
+	return stmt.SQL.String(), true, nil
+}
+
+// inlineSQLVars replace values with SQL literals, slices by a list of literals.
+// It return false if a value can not be written safely as a literal
+func inlineSQLVars(vars []interface{}) ([]interface{}, bool) {
+	inlined := make([]interface{}, len(vars))
+	for i, v := range vars {
+		if rv := reflect.ValueOf(v); (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() != reflect.Uint8 {
+			if _, isValuer := v.(driver.Valuer); !isValuer {
+				items := make([]interface{}, rv.Len())
+				for j := range items {
+					literal, ok := sqlLiteral(rv.Index(j).Interface())
+					if !ok {
+						return nil, false
+					}
+					items[j] = clause.Expr{SQL: literal}
+				}
+				inlined[i] = items
+				continue
+			}
+		}
+		literal, ok := sqlLiteral(v)
+		if !ok {
+			return nil, false
+		}
+		inlined[i] = clause.Expr{SQL: literal}
+	}
+	return inlined, true
+}
+
+// sqlLiteral write v as a SQL literal, it return false if v can not be written safely
+func sqlLiteral(v interface{}) (string, bool) {
+	if valuer, ok := v.(driver.Valuer); ok {
+		var err error
+		if v, err = valuer.Value(); err != nil {
+			return "", false
+		}
+	}
+	switch t := v.(type) {
+	case nil:
+		return "NULL", true
+	case string:
+		if strings.ContainsRune(t, 0) {
+			return "", false
+		}
+		return quoteLiteral(t), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", t), true
+	case float32, float64:
+		f := reflect.ValueOf(t).Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	case time.Time:
+		return quoteLiteral(t.Format(time.RFC3339Nano)) + "::timestamptz", true
+	default:
+		return "", false
+	}
+}
+
+// crlfWriter terminate lines with \r\n, carriage returns of the data are dropped like csv.Writer does
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (cw crlfWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+bytes.Count(p, []byte{'\n'}))
+	for _, b := range p {
+		switch b {
+		case '\r':
+		case '\n':
+			buf = append(buf, '\r', '\n')
+		default:
+			buf = append(buf, b)
+		}
+	}
+	if _, err := cw.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// quoteLiteral quote s as a SQL string literal, requires standard_conforming_strings
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
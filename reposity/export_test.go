@@ -0,0 +1,98 @@
+package reposity
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type exportItem struct {
+	ID        int64 `gorm:"primaryKey"`
+	Name      string
+	Note      string
+	CreatedAt time.Time
+}
+
+type exportItemDTO struct {
+	ID   int64
+	Name string
+	Note string
+}
+
+func TestCopySelectSQL(t *testing.T) {
+	db := newTestDB(t)
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		expression string
+		args       []interface{}
+		want       string
+	}{
+		{
+			name:       "literal looking like a placeholder",
+			expression: "note = '$1' AND name = ?",
+			args:       []interface{}{"it's"},
+			want:       `SELECT "id","name" FROM "export_items" WHERE note = '$1' AND name = 'it''s' ORDER BY "id" asc`,
+		},
+		{
+			name:       "question mark in argument",
+			expression: "name = ? AND note = ?",
+			args:       []interface{}{"why?", "$2"},
+			want:       `SELECT "id","name" FROM "export_items" WHERE name = 'why?' AND note = '$2' ORDER BY "id" asc`,
+		},
+		{
+			name:       "list and time",
+			expression: "id IN ? AND created_at > ?",
+			args:       []interface{}{[]int64{1, 2}, created},
+			want:       `SELECT "id","name" FROM "export_items" WHERE id IN (1,2) AND created_at > '2024-05-01T10:00:00Z'::timestamptz ORDER BY "id" asc`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := &SQLQuery[exportItemDTO, exportItem]{db: db, expressStr: tt.expression, args: tt.args}
+			got, ok, err := query.copySelectSQL([]string{"id", "name"}, "+id")
+			if err != nil || !ok {
+				t.Fatalf("copySelectSQL = %q, %v, %v", got, ok, err)
+			}
+			if got != tt.want {
+				t.Errorf("copySelectSQL =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("not inlinable", func(t *testing.T) {
+		for _, arg := range []interface{}{[]byte("raw"), "nul\x00", struct{}{}} {
+			query := &SQLQuery[exportItemDTO, exportItem]{db: db, expressStr: "name = ?", args: []interface{}{arg}}
+			if got, ok, err := query.copySelectSQL([]string{"id"}, ""); ok || err != nil {
+				t.Errorf("copySelectSQL(%v) = %q, %v, %v, want fallback", arg, got, ok, err)
+			}
+		}
+	})
+}
+
+// TestCRLFWriter check COPY output get the line endings of csv.Writer with UseCRLF
+func TestCRLFWriter(t *testing.T) {
+	records := [][]string{{"id", "note"}, {"1", "line\nbreak"}, {"2", "carriage\r\nreturn"}}
+
+	var want bytes.Buffer
+	writer := csv.NewWriter(&want)
+	writer.UseCRLF = true
+	if err := writer.WriteAll(records); err != nil {
+		t.Fatal(err)
+	}
+
+	// As COPY ... WITH (FORMAT csv) writes them
+	copyOutput := "id,note\n1,\"line\nbreak\"\n2,\"carriage\r\nreturn\"\n"
+	var got bytes.Buffer
+	for _, chunk := range strings.SplitAfter(copyOutput, "\n") {
+		if _, err := (crlfWriter{w: &got}).Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got.String() != want.String() {
+		t.Errorf("crlfWriter = %q, want %q", got.String(), want.String())
+	}
+}
@@ -0,0 +1,102 @@
+package reposity
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// dtoField describe one exported field of a DTO struct
+type dtoField struct {
+	Name  string // Go field name, used to match entity fields
+	Key   string // external name from csv/json tag, used for headers
+	JSON  string // name of the field in the DTO's JSON encoding
+	Index []int
+	Type  reflect.Type
+}
+
+// dtoFields collect exported fields of a DTO struct type (including fields of embedded structs).
+// The key of a field comes from its `csv` tag, then its `json` tag, then its Go name.
+// Fields tagged with "-" are skipped
+func dtoFields(t reflect.Type) []dtoField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	fields := make([]dtoField, 0, t.NumField())
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for _, sub := range dtoFields(f.Type) {
+				sub.Index = append([]int{i}, sub.Index...)
+				fields = append(fields, sub)
+			}
+			continue
+		}
+
+		key, jsonKey := f.Name, f.Name
+		skip := false
+		if v, ok := f.Tag.Lookup("json"); ok {
+			if name := strings.Split(v, ",")[0]; name == "-" {
+				skip = true
+			} else if name != "" {
+				key, jsonKey = name, name
+			}
+		}
+		if v, ok := f.Tag.Lookup("csv"); ok {
+			if name := strings.Split(v, ",")[0]; name == "-" {
+				skip = true
+			} else if name != "" {
+				key, skip = name, false
+			}
+		}
+		if skip {
+			continue
+		}
+		fields = append(fields, dtoField{Name: f.Name, Key: key, JSON: jsonKey, Index: f.Index, Type: f.Type})
+	}
+	return fields
+}
+
+// selectDTOFields pick fields by key or Go name in the given order, all fields if names is empty
+func selectDTOFields(t reflect.Type, names []string) ([]dtoField, error) {
+	fields := dtoFields(t)
+	if len(names) == 0 {
+		return fields, nil
+	}
+
+	selected := make([]dtoField, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, f := range fields {
+			if f.Key == name || f.JSON == name || f.Name == name {
+				selected = append(selected, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field %q of %s", name, t)
+		}
+	}
+	return selected, nil
+}
+
+// parseEntitySchema parse the gorm schema of entity type E with naming strategy of db
+func parseEntitySchema[E any](db *gorm.DB) (*schema.Schema, error) {
+	var entity E
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&entity); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
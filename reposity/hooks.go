@@ -0,0 +1,301 @@
+package reposity
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Hooks are repository level hooks of a dto (data transfer object) and entity pair, unlike GORM
+// hooks they see the caller's context and the dto. They run inside the transaction of the operation,
+// given as tx, a hook returning an error abort the operation and roll it back. Unset hooks are skipped.
+// Writes are only retried when their context is marked with MarkIdempotent (see RetryPolicy), hooks
+// then run again and their side effects outside the database like cache busting must be idempotent
+type Hooks[M any, E any] struct {
+	// BeforeCreate run after validation and mapping, before item is written: changes to item are written
+	BeforeCreate func(ctx context.Context, tx *gorm.DB, dto *M, item *E) error
+	// AfterCreate run after item is written and mapped back to dto, changes to dto are returned
+	AfterCreate func(ctx context.Context, tx *gorm.DB, dto *M, item *E) error
+	// BeforeUpdate run before item is written, old is the stored item and item has the new values
+	BeforeUpdate func(ctx context.Context, tx *gorm.DB, old *E, dto *M, item *E) error
+	// AfterUpdate run after item is written and mapped back to dto, changes to dto are returned
+	AfterUpdate func(ctx context.Context, tx *gorm.DB, old *E, dto *M, item *E) error
+	// BeforeDelete run before item is deleted
+	BeforeDelete func(ctx context.Context, tx *gorm.DB, item *E) error
+	// AfterDelete run after item is deleted
+	AfterDelete func(ctx context.Context, tx *gorm.DB, item *E) error
+	// AfterRead run for each item read and mapped to dto, changes to dto are returned
+	AfterRead func(ctx context.Context, tx *gorm.DB, dto *M, item *E) error
+}
+
+// hooksEntry is a registration of RegisterHooks, update and delete hooks are also kept untyped
+// for the helpers which only know the entity
+type hooksEntry struct {
+	hooks        interface{} // Hooks[M, E]
+	beforeUpdate func(ctx context.Context, tx *gorm.DB, old interface{}, item interface{}) error
+	afterUpdate  func(ctx context.Context, tx *gorm.DB, old interface{}, item interface{}) error
+	beforeDelete func(ctx context.Context, tx *gorm.DB, item interface{}) error
+	afterDelete  func(ctx context.Context, tx *gorm.DB, item interface{}) error
+}
+
+var (
+	hooksMu sync.RWMutex
+	hooks   = map[reflect.Type][]hooksEntry{} // by entity type
+)
+
+// RegisterHooks add hooks to the helpers reading and writing entity E through dto M, they run in
+// every helper creating, updating or deleting items of E:
+//   - create hooks in CreateItemFromDTO, CreateManyFromDTO, Import, and the upserts when the item is inserted
+//   - update hooks in UpdateItemByIDFromDTO, UpdateItemByIDWithMask, MergePatchItemByID, ReplaceItemByIDFromDTO,
+//     PatchItemByID, UpdateItemByIDIfVersion, UpdateItemByIDIfMatch, and the upserts when the item is updated
+//   - read hooks in ReadItemByIDIntoDTO, ReadMultiItemsByIDIntoDTO, ReadAllItemsIntoDTO and ReadItemWithFilterIntoDTO
+//
+// Helpers without dto run the hooks of every registration with E, the item is mapped to the dto of each:
+// update hooks in UpdateSingleColumn, UpdateWhere, RestoreItemByID and RestoreItemByIDCascade, where changes
+// to dto are dropped, and delete hooks in DeleteItemByID, HardDeleteItemByID, DeleteItemByIDCascade,
+// DeleteWhere, DeleteAllItem and PurgeDeletedOlderThan. Bulk helpers then write the items one by one,
+// items reached through a cascade do not run hooks. Hooks run in registration order, they must be
+// registered before use
+func RegisterHooks[M any, E any](h Hooks[M, E]) {
+	entry := hooksEntry{hooks: h}
+	if h.BeforeUpdate != nil {
+		entry.beforeUpdate = func(ctx context.Context, tx *gorm.DB, old interface{}, item interface{}) error {
+			var dto M
+			if err := MapToDTO(&dto, *item.(*E)); err != nil {
+				return err
+			}
+			return h.BeforeUpdate(ctx, tx, old.(*E), &dto, item.(*E))
+		}
+	}
+	if h.AfterUpdate != nil {
+		entry.afterUpdate = func(ctx context.Context, tx *gorm.DB, old interface{}, item interface{}) error {
+			var dto M
+			if err := MapToDTO(&dto, *item.(*E)); err != nil {
+				return err
+			}
+			return h.AfterUpdate(ctx, tx, old.(*E), &dto, item.(*E))
+		}
+	}
+	if h.BeforeDelete != nil {
+		entry.beforeDelete = func(ctx context.Context, tx *gorm.DB, item interface{}) error {
+			return h.BeforeDelete(ctx, tx, item.(*E))
+		}
+	}
+	if h.AfterDelete != nil {
+		entry.afterDelete = func(ctx context.Context, tx *gorm.DB, item interface{}) error {
+			return h.AfterDelete(ctx, tx, item.(*E))
+		}
+	}
+
+	entityType := reflect.TypeOf((*E)(nil)).Elem()
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks[entityType] = append(hooks[entityType], entry)
+}
+
+// hooksFor return the hooks registered for dto M and entity E
+func hooksFor[M any, E any]() []Hooks[M, E] {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	var found []Hooks[M, E]
+	for _, entry := range hooks[reflect.TypeOf((*E)(nil)).Elem()] {
+		if h, ok := entry.hooks.(Hooks[M, E]); ok {
+			found = append(found, h)
+		}
+	}
+	return found
+}
+
+// deleteHooksFor return the registrations of entity E with delete hooks
+func deleteHooksFor[E any]() []hooksEntry {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	var found []hooksEntry
+	for _, entry := range hooks[reflect.TypeOf((*E)(nil)).Elem()] {
+		if entry.beforeDelete != nil || entry.afterDelete != nil {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// updateHooksFor return the registrations of entity E with update hooks
+func updateHooksFor[E any]() []hooksEntry {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	var found []hooksEntry
+	for _, entry := range hooks[reflect.TypeOf((*E)(nil)).Elem()] {
+		if entry.beforeUpdate != nil || entry.afterUpdate != nil {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// runHooks call hook for each registration which set it, it stop at the first error
+func runHooks[H any](registered []H, hook func(H) error) error {
+	for _, h := range registered {
+		if err := hook(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// afterRead run the AfterRead hooks of dto and item
+func afterRead[M any, E any](ctx context.Context, db *gorm.DB, registered []Hooks[M, E], dto *M, item *E) error {
+	return runHooks(registered, func(h Hooks[M, E]) error {
+		if h.AfterRead == nil {
+			return nil
+		}
+		return wrapHookError("after read", h.AfterRead(ctx, db, dto, item))
+	})
+}
+
+// beforeCreate run the BeforeCreate hooks of dto and item
+func beforeCreate[M any, E any](db *gorm.DB, registered []Hooks[M, E], dto *M, item *E) error {
+	ctx := statementContext(db)
+	return runHooks(registered, func(h Hooks[M, E]) error {
+		if h.BeforeCreate == nil {
+			return nil
+		}
+		return wrapHookError("before create", h.BeforeCreate(ctx, db, dto, item))
+	})
+}
+
+// afterCreate audit the written item, map it back to dto and run the AfterCreate hooks
+func afterCreate[M any, E any](db *gorm.DB, registered []Hooks[M, E], dto *M, item *E) error {
+	after, err := auditSnapshot(db, item)
+	if err != nil {
+		return err
+	}
+	if err := writeAudit(db, AuditCreate, item, nil, after); err != nil {
+		return err
+	}
+	if err := MapToDTO(dto, *item); err != nil {
+		return err
+	}
+	ctx := statementContext(db)
+	return runHooks(registered, func(h Hooks[M, E]) error {
+		if h.AfterCreate == nil {
+			return nil
+		}
+		return wrapHookError("after create", h.AfterCreate(ctx, db, dto, item))
+	})
+}
+
+// updateWithHooks run the BeforeUpdate hooks, write item and audit the change, then map it back
+// to updated and run the AfterUpdate hooks. old is the stored item and dto the input of the update
+func updateWithHooks[M any, E any](db *gorm.DB, registered []Hooks[M, E], old *E, dto *M, item *E, updated *M, write func() error) error {
+	ctx := statementContext(db)
+	before, err := auditSnapshot(db, old)
+	if err != nil {
+		return err
+	}
+	err = runHooks(registered, func(h Hooks[M, E]) error {
+		if h.BeforeUpdate == nil {
+			return nil
+		}
+		return wrapHookError("before update", h.BeforeUpdate(ctx, db, old, dto, item))
+	})
+	if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	if err := auditUpdate(db, item, before); err != nil {
+		return err
+	}
+
+	if err := MapToDTO(updated, *item); err != nil {
+		return err
+	}
+	return runHooks(registered, func(h Hooks[M, E]) error {
+		if h.AfterUpdate == nil {
+			return nil
+		}
+		return wrapHookError("after update", h.AfterUpdate(ctx, db, old, updated, item))
+	})
+}
+
+// updateEntityWithHooks run the update hooks of every registration of E around write and audit
+// the change, for the helpers without dto
+func updateEntityWithHooks[E any](db *gorm.DB, registered []hooksEntry, old *E, item *E, write func() error) error {
+	ctx := statementContext(db)
+	before, err := auditSnapshot(db, old)
+	if err != nil {
+		return err
+	}
+	for _, entry := range registered {
+		if entry.beforeUpdate != nil {
+			if err := entry.beforeUpdate(ctx, db, old, item); err != nil {
+				return wrapHookError("before update", err)
+			}
+		}
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	if err := auditUpdate(db, item, before); err != nil {
+		return err
+	}
+	for _, entry := range registered {
+		if entry.afterUpdate != nil {
+			if err := entry.afterUpdate(ctx, db, old, item); err != nil {
+				return wrapHookError("after update", err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteWithHooks run the delete hooks of every registration of E around remove, and audit the
+// deletion of item
+func deleteWithHooks[E any](db *gorm.DB, registered []hooksEntry, item *E, remove func() error) error {
+	ctx := statementContext(db)
+	before, err := auditSnapshot(db, item)
+	if err != nil {
+		return err
+	}
+	for _, entry := range registered {
+		if entry.beforeDelete != nil {
+			if err := entry.beforeDelete(ctx, db, item); err != nil {
+				return wrapHookError("before delete", err)
+			}
+		}
+	}
+	if err := remove(); err != nil {
+		return err
+	}
+	if err := writeAudit(db, AuditDelete, item, before, nil); err != nil {
+		return err
+	}
+	for _, entry := range registered {
+		if entry.afterDelete != nil {
+			if err := entry.afterDelete(ctx, db, item); err != nil {
+				return wrapHookError("after delete", err)
+			}
+		}
+	}
+	return nil
+}
+
+// wrapHookError name the hook which returned err, nil stays nil
+func wrapHookError(hook string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s hook: %w", hook, err)
+}
+
+// statementContext return the context of db's statements
+func statementContext(db *gorm.DB) context.Context {
+	if db.Statement.Context == nil {
+		return context.Background()
+	}
+	return db.Statement.Context
+}
@@ -0,0 +1,195 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type hookItem struct {
+	ID   int64 `gorm:"primaryKey"`
+	Code string
+	Name string
+}
+
+type hookItemDTO struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+func TestUpdateWithHooks(t *testing.T) {
+	db := newTestDB(t)
+	var calls []string
+	registered := []Hooks[hookItemDTO, hookItem]{
+		{
+			BeforeUpdate: func(ctx context.Context, tx *gorm.DB, old *hookItem, dto *hookItemDTO, item *hookItem) error {
+				calls = append(calls, "before "+old.Name+" -> "+item.Name)
+				item.Name += "!"
+				return nil
+			},
+		},
+		{
+			AfterUpdate: func(ctx context.Context, tx *gorm.DB, old *hookItem, dto *hookItemDTO, item *hookItem) error {
+				calls = append(calls, "after "+dto.Name)
+				return nil
+			},
+		},
+	}
+
+	old := hookItem{ID: 1, Name: "Bob"}
+	item := hookItem{ID: 1, Name: "Robert"}
+	dto := hookItemDTO{Name: "Robert"}
+	var updated hookItemDTO
+	err := updateWithHooks(db, registered, &old, &dto, &item, &updated, func() error {
+		calls = append(calls, "write "+item.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"before Bob -> Robert", "write Robert!", "after Robert!"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if updated.Name != "Robert!" {
+		t.Errorf("updated = %+v, want the written item", updated)
+	}
+
+	// A failing hook stops the update before the write
+	calls = nil
+	failing := []Hooks[hookItemDTO, hookItem]{{
+		BeforeUpdate: func(context.Context, *gorm.DB, *hookItem, *hookItemDTO, *hookItem) error {
+			return errors.New("denied")
+		},
+	}}
+	err = updateWithHooks(db, failing, &old, &dto, &item, &updated, func() error {
+		calls = append(calls, "write")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "before update hook: denied") {
+		t.Errorf("updateWithHooks = %v, want the hook error", err)
+	}
+	if len(calls) > 0 {
+		t.Errorf("item written after a failing hook: %q", calls)
+	}
+}
+
+type entityHookItem struct {
+	ID   int64 `gorm:"primaryKey"`
+	Name string
+}
+
+type entityHookItemDTO struct {
+	Name string `json:"name"`
+}
+
+func TestUpdateEntityWithHooks(t *testing.T) {
+	db := newTestDB(t)
+	var calls []string
+	RegisterHooks(Hooks[entityHookItemDTO, entityHookItem]{
+		BeforeUpdate: func(ctx context.Context, tx *gorm.DB, old *entityHookItem, dto *entityHookItemDTO, item *entityHookItem) error {
+			calls = append(calls, "before "+old.Name+" -> "+dto.Name)
+			return nil
+		},
+		AfterUpdate: func(ctx context.Context, tx *gorm.DB, old *entityHookItem, dto *entityHookItemDTO, item *entityHookItem) error {
+			calls = append(calls, "after "+dto.Name)
+			return nil
+		},
+	})
+	registered := updateHooksFor[entityHookItem]()
+	if len(registered) != 1 {
+		t.Fatalf("updateHooksFor found %d registrations, want 1", len(registered))
+	}
+
+	old := entityHookItem{ID: 1, Name: "Bob"}
+	item := entityHookItem{ID: 1, Name: "Robert"}
+	err := updateEntityWithHooks(db, registered, &old, &item, func() error {
+		calls = append(calls, "write")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"before Bob -> Robert", "write", "after Robert"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestAssignBulkValues(t *testing.T) {
+	db := newTestDB(t)
+	entitySchema, err := parseEntitySchema[hookItem](db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		values      interface{}
+		want        hookItem
+		wantColumns []string
+		wantErr     bool
+	}{
+		{name: "map", values: map[string]interface{}{"name": "Robert", "Code": "B2"}, want: hookItem{ID: 1, Code: "B2", Name: "Robert"}, wantColumns: []string{"code", "name"}},
+		{name: "entity", values: &hookItem{ID: 9, Name: "Robert"}, want: hookItem{ID: 1, Code: "A1", Name: "Robert"}, wantColumns: []string{"name"}},
+		{name: "unknown column", values: map[string]interface{}{"missing": 1}, wantErr: true},
+		{name: "not assignable", values: map[string]interface{}{"name": gorm.Expr("upper(name)")}, wantErr: true},
+		{name: "empty entity", values: &hookItem{}, wantErr: true},
+		{name: "unsupported", values: 42, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := hookItem{ID: 1, Code: "A1", Name: "Bob"}
+			columns, err := assignBulkValues(db, entitySchema, &item, tt.values)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("assignBulkValues = %q, want an error", columns)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(columns)
+			if item != tt.want || !reflect.DeepEqual(columns, tt.wantColumns) {
+				t.Errorf("assignBulkValues = %+v %q, want %+v %q", item, columns, tt.want, tt.wantColumns)
+			}
+		})
+	}
+}
+
+func TestLockConflictingItem(t *testing.T) {
+	tx := newTestDB(t).Session(&gorm.Session{DryRun: true})
+
+	tests := []struct {
+		name    string
+		item    hookItem
+		opts    UpsertOptions
+		wantErr string
+	}{
+		{name: "generated primary key", item: hookItem{Code: "A1"}},
+		{name: "primary key", item: hookItem{ID: 1}},
+		{name: "conflict columns", item: hookItem{Code: "A1"}, opts: UpsertOptions{ConflictColumns: []string{"code"}}},
+		{name: "unknown column", item: hookItem{Code: "A1"}, opts: UpsertOptions{ConflictColumns: []string{"sku"}}, wantErr: "has no column sku"},
+		{name: "constraint", item: hookItem{Code: "A1"}, opts: UpsertOptions{ConflictConstraint: "uq_code"}, wantErr: "ConflictConstraint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, err := lockConflictingItem(tx, &tt.item, tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("lockConflictingItem = %v, want error %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || old != nil {
+				t.Errorf("lockConflictingItem = %v, %v, want no stored item in dry run", old, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package reposity
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// ImportMode decide what happens to accepted rows when other rows are rejected
+type ImportMode int
+
+const (
+	// ImportAllOrNothing write nothing if any row is rejected
+	ImportAllOrNothing ImportMode = iota
+	// ImportBestEffort write every accepted row and report the rejected ones
+	ImportBestEffort
+)
+
+// DefaultImportBatchSize is the number of rows written per INSERT by Import
+const DefaultImportBatchSize = 100
+
+// ImportOptions configure Import. The zero value imports all or nothing,
+// comma separated CSV and RFC 3339 times
+type ImportOptions struct {
+	Mode       ImportMode
+	DryRun     bool   // parse, validate and map rows without writing them
+	BatchSize  int    // rows per INSERT, default DefaultImportBatchSize
+	Delimiter  rune   // CSV field delimiter, default ','
+	TimeLayout string // layout for time values in CSV, default time.RFC3339
+}
+
+// ImportReport summarize the result of Import
+type ImportReport struct {
+	Total    int // rows read from input
+	Accepted int // rows that passed parsing and validation
+	Inserted int // rows written into database, 0 on dry-run or when rolled back
+	Rejected []RejectedRow
+}
+
+// RejectedRow describe why one input row was not imported
+type RejectedRow struct {
+	Line   int               // line number in the input, the CSV header is line 1
+	Fields map[string]string // field key -> failed rule or parse error
+	Err    error             // parse or write error, or the *ValidationError of the row
+}
+
+// errImportRollback abort the import transaction without reporting an error
+var errImportRollback = errors.New("import rolled back")
+
+// Import read rows from r into dto (data transfer object), validate each with the same validator
+// as CreateItemFromDTO, map them to entity model and insert in batches, accepts generic types.
+// CSV columns are matched with the `csv` or `json` tags of the DTO. The create hooks run for each
+// written row, except on dry-run, and a hook error aborts the import
+//
+// It return a report of accepted and rejected rows, and error if the import could not run
+func Import[M any, E any](ctx context.Context, r io.Reader, format DataFormat, opts ImportOptions) (report ImportReport, err error) {
+	if !Connected {
+		return report, ErrNotConnected
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = DefaultImportBatchSize
+	}
+	if opts.Delimiter == 0 {
+		opts.Delimiter = ','
+	}
+	if opts.TimeLayout == "" {
+		opts.TimeLayout = time.RFC3339
+	}
+
+	var dto M
+	fields := dtoFields(reflect.TypeOf(dto))
+	registered := hooksFor[M, E]()
+
+	err = dbError(defaultDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		batch := make([]E, 0, opts.BatchSize)
+		dtos := make([]M, 0, opts.BatchSize)
+		lines := make([]int, 0, opts.BatchSize)
+
+		flush := func() error {
+			if len(batch) == 0 || opts.DryRun {
+				batch, dtos, lines = batch[:0], dtos[:0], lines[:0]
+				return nil
+			}
+			failed, err := insertBatch(tx, batch)
+			if err != nil {
+				return err
+			}
+			report.Inserted += len(batch) - len(failed)
+			rejected := make(map[int]bool, len(failed))
+			for _, f := range failed {
+				rejected[f.Index] = true
+				report.Rejected = append(report.Rejected, RejectedRow{Line: lines[f.Index], Err: f.Err})
+			}
+
+			// Audit and after hooks of the inserted rows, a hook error aborts the import
+			if len(registered) > 0 || isAudited[E]() {
+				for i := range batch {
+					if rejected[i] {
+						continue
+					}
+					if err := afterCreate(tx, registered, &dtos[i], &batch[i]); err != nil {
+						return fmt.Errorf("line %d: %w", lines[i], err)
+					}
+				}
+			}
+			batch, dtos, lines = batch[:0], dtos[:0], lines[:0]
+			return nil
+		}
+
+		accept := func(line int, dto M, fieldErrs map[string]string, rowErr error) error {
+			report.Total++
+			if rowErr == nil && len(fieldErrs) == 0 {
+				var err error
+				if fieldErrs, err = validateImportRow[E](tx, dto, fields); err != nil {
+					// Database backed rules failing to run abort the import
+					var validationErr *ValidationError
+					if !errors.As(err, &validationErr) {
+						return err
+					}
+					rowErr = validationErr
+				}
+			}
+			if rowErr != nil || len(fieldErrs) > 0 {
+				report.Rejected = append(report.Rejected, RejectedRow{Line: line, Fields: fieldErrs, Err: rowErr})
+				return nil
+			}
+
+			// Mapping from DTO to entity model
+			var item E
+			if err := MapToEntity(&item, dto); err != nil {
+				report.Rejected = append(report.Rejected, RejectedRow{Line: line, Err: err})
+				return nil
+			}
+			if !opts.DryRun {
+				if err := beforeCreate(tx, registered, &dto, &item); err != nil {
+					return fmt.Errorf("line %d: %w", line, err)
+				}
+			}
+			report.Accepted++
+			batch = append(batch, item)
+			dtos = append(dtos, dto)
+			lines = append(lines, line)
+			if len(batch) >= opts.BatchSize {
+				return flush()
+			}
+			return ctx.Err()
+		}
+
+		switch format {
+		case FormatCSV:
+			err = readImportCSV(r, opts, accept)
+		case FormatNDJSON:
+			err = readImportNDJSON(r, accept)
+		default:
+			err = fmt.Errorf("unsupported import format %q", format)
+		}
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		if opts.DryRun || (opts.Mode == ImportAllOrNothing && len(report.Rejected) > 0) {
+			return errImportRollback
+		}
+		return nil
+	}))
+
+	if errors.Is(err, errImportRollback) {
+		report.Inserted = 0
+		return report, nil
+	}
+	if err != nil {
+		report.Inserted = 0
+	}
+	return report, err
+}
+
+// validateImportRow validate dto of entity E like CreateItemFromDTO, database backed rules run on tx.
+// It return validation failures keyed by field key, and the *ValidationError
+func validateImportRow[E any](tx *gorm.DB, dto any, fields []dtoField) (map[string]string, error) {
+	err := validateItem[E](tx, dto, nil)
+	if err == nil {
+		return nil, nil
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil, err
+	}
+	fieldErrs := make(map[string]string, len(validationErrs))
+	for _, fe := range validationErrs {
+		key := fe.StructField()
+		for _, f := range fields {
+			if f.Name == fe.StructField() {
+				key = f.Key
+				break
+			}
+		}
+		rule := fe.Tag()
+		if fe.Param() != "" {
+			rule += "=" + fe.Param()
+		}
+		fieldErrs[key] = rule
+	}
+	return fieldErrs, err
+}
+
+// readImportCSV read a header row then parse each record into a DTO
+func readImportCSV[M any](r io.Reader, opts ImportOptions, accept func(int, M, map[string]string, error) error) error {
+	reader := csv.NewReader(r)
+	reader.Comma = opts.Delimiter
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], utf8BOM)
+	}
+	columns, err := selectDTOFields(reflect.TypeOf((*M)(nil)).Elem(), header)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return err
+			}
+			if err := accept(parseErr.StartLine, *new(M), nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		var dto M
+		var fieldErrs map[string]string
+		if len(record) != len(columns) {
+			err = fmt.Errorf("expected %d fields, got %d", len(columns), len(record))
+		} else {
+			v := reflect.ValueOf(&dto).Elem()
+			for i, f := range columns {
+				if perr := parseImportValue(v.FieldByIndex(f.Index), record[i], opts.TimeLayout); perr != nil {
+					if fieldErrs == nil {
+						fieldErrs = make(map[string]string)
+					}
+					fieldErrs[f.Key] = perr.Error()
+				}
+			}
+		}
+		if err := accept(line, dto, fieldErrs, err); err != nil {
+			return err
+		}
+	}
+}
+
+// readImportNDJSON decode each non-empty line as one DTO
+func readImportNDJSON[M any](r io.Reader, accept func(int, M, map[string]string, error) error) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) > 0 {
+			var dto M
+			rowErr := json.Unmarshal(b, &dto)
+			if err := accept(line, dto, nil, rowErr); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseImportValue parse a CSV cell into v, empty cell leave the zero value
+func parseImportValue(v reflect.Value, s string, timeLayout string) error {
+	if s == "" {
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		elem := reflect.New(v.Type().Elem())
+		if err := parseImportValue(elem.Elem(), s, timeLayout); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+
+	if scanner, ok := v.Addr().Interface().(sql.Scanner); ok {
+		return scanner.Scan(s)
+	}
+	if _, ok := v.Interface().(time.Time); ok {
+		t, err := time.Parse(timeLayout, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		// Structs, maps and slices are read as JSON
+		return json.Unmarshal([]byte(s), v.Addr().Interface())
+	}
+	return nil
+}
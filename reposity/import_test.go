@@ -0,0 +1,41 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type importItem struct {
+	ID    int64 `gorm:"primaryKey"`
+	Name  string
+	Email string
+}
+
+type importItemDTO struct {
+	Name  string `json:"name" csv:"full_name" validate:"required"`
+	Email string `json:"email" validate:"omitempty,email"`
+}
+
+func TestValidateImportRow(t *testing.T) {
+	tx := newTestDB(t).WithContext(WithLocale(context.Background(), LocaleVietnamese))
+	fields := dtoFields(reflect.TypeOf(importItemDTO{}))
+
+	if fieldErrs, err := validateImportRow[importItem](tx, importItemDTO{Name: "Bob"}, fields); err != nil || fieldErrs != nil {
+		t.Fatalf("validateImportRow(valid) = %v, %v", fieldErrs, err)
+	}
+
+	fieldErrs, err := validateImportRow[importItem](tx, importItemDTO{Email: "bob"}, fields)
+	want := map[string]string{"full_name": "required", "email": "email"}
+	if !reflect.DeepEqual(fieldErrs, want) {
+		t.Errorf("fieldErrs = %v, want %v", fieldErrs, want)
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("err = %v, want a *ValidationError", err)
+	}
+	if english := validationErr.Translate(LocaleEnglish); english.Fields["name"]["required"] == validationErr.Fields["name"]["required"] {
+		t.Errorf("message %q is not in the locale of the context", validationErr.Fields["name"]["required"])
+	}
+}
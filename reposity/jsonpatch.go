@@ -0,0 +1,378 @@
+package reposity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrPatchTestFailed is returned when a "test" operation of a JSON Patch does not match
+var ErrPatchTestFailed = errors.New("json patch test operation failed")
+
+// patchOperation is one operation of a RFC 6902 JSON Patch document
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// PatchItemByID lock the item by ID inside a transaction, then apply a RFC 6902 JSON Patch
+// to its dto (data transfer object) representation, accepts generic types. Paths may point inside
+// nested objects such as JSONB fields. The result is validated and only changed columns are written,
+// nothing is written if any operation (including "test") fails
+//
+// It return updated item (dto) and error
+func PatchItemByID[M any, E any, K comparable](id K, patch []byte) (dto M, err error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return dto, err
+	}
+
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return dto, fmt.Errorf("invalid json patch: %w", err)
+	}
+
+	// dto is only set once the transaction commits, for retries
+	var updated M
+	err = transaction(context.Background(), "PatchItemByID", false, func(tx *gorm.DB) error {
+		var item E
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(cond).First(&item).Error; err != nil {
+			return err
+		}
+
+		// Mapping from entity model to a fresh DTO model (the transaction may be retried), then to a JSON document
+		var current M
+		if err := MapToDTO(&current, item); err != nil {
+			return err
+		}
+		var before interface{}
+		if err := remarshalJSON(current, &before); err != nil {
+			return err
+		}
+		var doc interface{}
+		if err := remarshalJSON(current, &doc); err != nil {
+			return err
+		}
+
+		var err error
+		for i, operation := range operations {
+			if doc, err = applyPatchOperation(doc, operation); err != nil {
+				return fmt.Errorf("json patch operation %d (%s %s): %w", i, operation.Op, operation.Path, err)
+			}
+		}
+
+		// Read the result back into a fresh DTO and validate it
+		var patched M
+		if err := remarshalJSON(doc, &patched); err != nil {
+			return err
+		}
+		if err := validateItem[E](tx, patched, cond); err != nil {
+			return err
+		}
+
+		// Write only the top-level fields whose value changed
+		beforeObj, _ := before.(map[string]interface{})
+		afterObj, _ := doc.(map[string]interface{})
+		changed := make([]string, 0)
+		for key, value := range afterObj {
+			if old, ok := beforeObj[key]; !ok || !jsonEqual(old, value) {
+				changed = append(changed, key)
+			}
+		}
+		for key := range beforeObj {
+			if _, ok := afterObj[key]; !ok {
+				changed = append(changed, key)
+			}
+		}
+		if len(changed) == 0 {
+			updated = current
+			return nil
+		}
+		fields, err := selectDTOFields(reflect.TypeOf(current), changed)
+		if err != nil {
+			return err
+		}
+
+		updated, err = writeItemFields(tx, cond, &item, patched, fields, true)
+		return err
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// applyPatchOperation apply one operation to doc and return the new document
+func applyPatchOperation(doc interface{}, operation patchOperation) (interface{}, error) {
+	path, err := parseJSONPointer(operation.Path)
+	if err != nil {
+		return doc, err
+	}
+
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return doc, errors.New("missing value")
+		}
+		if err := decodeJSON(operation.Value, &value); err != nil {
+			return doc, err
+		}
+	}
+
+	switch operation.Op {
+	case "add":
+		return jsonPointerAdd(doc, path, value)
+	case "remove":
+		return jsonPointerRemove(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		return updateJSONContainer(doc, path, func(container interface{}, key string) (interface{}, error) {
+			switch c := container.(type) {
+			case map[string]interface{}:
+				if _, ok := c[key]; !ok {
+					return nil, fmt.Errorf("member %q not found", key)
+				}
+				c[key] = value
+				return c, nil
+			case []interface{}:
+				i, err := jsonArrayIndex(key, len(c)-1)
+				if err != nil {
+					return nil, err
+				}
+				c[i] = value
+				return c, nil
+			default:
+				return nil, fmt.Errorf("can not replace %q in a scalar", key)
+			}
+		})
+	case "move", "copy":
+		from, err := parseJSONPointer(operation.From)
+		if err != nil {
+			return doc, err
+		}
+		value, err := jsonPointerGet(doc, from)
+		if err != nil {
+			return doc, err
+		}
+		if operation.Op == "move" {
+			if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+				return doc, errors.New("can not move a value into one of its children")
+			}
+			if doc, err = jsonPointerRemove(doc, from); err != nil {
+				return doc, err
+			}
+		} else {
+			// Copy a deep clone so later operations do not alias both locations
+			var clone interface{}
+			if err := remarshalJSON(value, &clone); err != nil {
+				return doc, err
+			}
+			value = clone
+		}
+		return jsonPointerAdd(doc, path, value)
+	case "test":
+		current, err := jsonPointerGet(doc, path)
+		if err != nil {
+			return doc, err
+		}
+		if !jsonEqual(current, value) {
+			return doc, ErrPatchTestFailed
+		}
+		return doc, nil
+	default:
+		return doc, fmt.Errorf("unknown operation %q", operation.Op)
+	}
+}
+
+// parseJSONPointer split a RFC 6901 JSON Pointer into unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// jsonArrayIndex parse an array index token, max is the largest allowed index
+func jsonArrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max {
+		return 0, fmt.Errorf("array index %q out of bounds", token)
+	}
+	return i, nil
+}
+
+// updateJSONContainer walk node to the parent of the last token and call fn with it,
+// the container returned by fn replaces the old one in its own parent
+func updateJSONContainer(node interface{}, tokens []string, fn func(container interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(node, tokens[0])
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("member %q not found", tokens[0])
+		}
+		updated, err := updateJSONContainer(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[tokens[0]] = updated
+		return n, nil
+	case []interface{}:
+		i, err := jsonArrayIndex(tokens[0], len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateJSONContainer(n[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = updated
+		return n, nil
+	default:
+		return nil, fmt.Errorf("path %q goes through a scalar", tokens[0])
+	}
+}
+
+func jsonPointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	node := doc
+	for _, token := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			node = child
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("path %q goes through a scalar", token)
+		}
+	}
+	return node, nil
+}
+
+func jsonPointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updateJSONContainer(doc, tokens, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[key] = value
+			return c, nil
+		case []interface{}:
+			if key == "-" {
+				return append(c, value), nil
+			}
+			i, err := jsonArrayIndex(key, len(c))
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		default:
+			return nil, fmt.Errorf("can not add %q to a scalar", key)
+		}
+	})
+}
+
+func jsonPointerRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("can not remove the whole document")
+	}
+	return updateJSONContainer(doc, tokens, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[key]; !ok {
+				return nil, fmt.Errorf("member %q not found", key)
+			}
+			delete(c, key)
+			return c, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(key, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("can not remove %q from a scalar", key)
+		}
+	})
+}
+
+// jsonEqual compare two decoded JSON values, numbers are compared by value
+func jsonEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if av == bv {
+			return true
+		}
+		af, aerr := av.Float64()
+		bf, berr := bv.Float64()
+		return aerr == nil && berr == nil && af == bf
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, value := range av {
+			other, ok := bv[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,103 @@
+package reposity
+
+import (
+	"errors"
+	"testing"
+)
+
+// applyPatch apply a JSON Patch document to a JSON document like PatchItemByID
+func applyPatch(t *testing.T, doc, patch string) (interface{}, error) {
+	t.Helper()
+	var node interface{}
+	if err := decodeJSON([]byte(doc), &node); err != nil {
+		t.Fatal(err)
+	}
+	var operations []patchOperation
+	if err := decodeJSON([]byte(patch), &operations); err != nil {
+		t.Fatal(err)
+	}
+	for _, operation := range operations {
+		var err error
+		if node, err = applyPatchOperation(node, operation); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// TestApplyPatchOperation run the examples of RFC 6902 appendix A
+func TestApplyPatchOperation(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"add to array end", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{"add nested member", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{"add null value", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":null}]`, `{"foo":"bar","baz":null}`},
+		{"remove member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace value", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"replace document", `{"foo":"bar"}`, `[{"op":"replace","path":"","value":{"baz":1}}]`, `{"baz":1}`},
+		{"move value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"copy value", `{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"foo":{"bar":1},"baz":{"bar":2}}`},
+		{"test value", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{"test number by value", `{"n":1}`, `[{"op":"test","path":"/n","value":1.0}]`, `{"n":1}`},
+		{"escaped keys", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyPatch(t, tt.doc, tt.patch)
+			if err != nil {
+				t.Fatalf("apply patch: %v", err)
+			}
+			var want interface{}
+			if err := decodeJSON([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyPatchOperationErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+	}{
+		{"add to missing parent", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{"add past array end", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`},
+		{"leading zero index", `{"foo":["bar","baz"]}`, `[{"op":"remove","path":"/foo/01"}]`},
+		{"remove missing member", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{"remove document", `{"foo":"bar"}`, `[{"op":"remove","path":""}]`},
+		{"replace missing member", `{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{"missing value", `{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`},
+		{"move into child", `{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`},
+		{"path without slash", `{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`},
+		{"path through scalar", `{"foo":"bar"}`, `[{"op":"add","path":"/foo/bar","value":1}]`},
+		{"unknown operation", `{"foo":"bar"}`, `[{"op":"merge","path":"/foo"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := applyPatch(t, tt.doc, tt.patch); err == nil {
+				t.Errorf("got %v, want an error", got)
+			}
+		})
+	}
+
+	t.Run("failed test", func(t *testing.T) {
+		_, err := applyPatch(t, `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`)
+		if !errors.Is(err, ErrPatchTestFailed) {
+			t.Errorf("err = %v, want ErrPatchTestFailed", err)
+		}
+	})
+}
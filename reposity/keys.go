@@ -0,0 +1,147 @@
+package reposity
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// primaryKeyCondition build the condition selecting the item of entity E whose primary key is key.
+// The primary key columns are discovered from the GORM schema. For a single column key, key is
+// its value (string, int64, uuid.UUID...). For a composite key, key is a struct with a field per
+// primary key column, matched by Go field name or column name, e.g. struct{ TenantID, Code string }
+func primaryKeyCondition[E any, K comparable](db *gorm.DB, key K) (clause.Expression, error) {
+	fields, err := primaryKeyFields[E](db)
+	if err != nil {
+		return nil, err
+	}
+	values, err := primaryKeyValues(db, fields, key)
+	if err != nil {
+		return nil, err
+	}
+
+	conds := make([]clause.Expression, len(fields))
+	for i, field := range fields {
+		conds[i] = clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: values[i]}
+	}
+	return clause.And(conds...), nil
+}
+
+// primaryKeysCondition build the condition selecting the items of entity E whose primary key is one of keys
+func primaryKeysCondition[E any, K comparable](db *gorm.DB, keys []K) (clause.Expression, error) {
+	fields, err := primaryKeyFields[E](db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Single column: column IN (...)
+	if len(fields) == 1 {
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			keyValues, err := primaryKeyValues(db, fields, key)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = keyValues[0]
+		}
+		return clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: fields[0].DBName}, Values: values}, nil
+	}
+
+	// Composite: (a = ? AND b = ?) OR (a = ? AND b = ?) ...
+	conds := make([]clause.Expression, len(keys))
+	for i, key := range keys {
+		cond, err := primaryKeyCondition[E](db, key)
+		if err != nil {
+			return nil, err
+		}
+		conds[i] = cond
+	}
+	if len(conds) == 0 {
+		return clause.Expr{SQL: "FALSE"}, nil
+	}
+	return clause.Or(conds...), nil
+}
+
+// itemKeyCondition build the condition selecting item by the values of its primary key fields
+func itemKeyCondition[E any](db *gorm.DB, item *E) (clause.Expression, error) {
+	fields, err := primaryKeyFields[E](db)
+	if err != nil {
+		return nil, err
+	}
+	ctx := statementContext(db)
+	conds := make([]clause.Expression, len(fields))
+	for i, field := range fields {
+		value, _ := field.ValueOf(ctx, reflect.ValueOf(item).Elem())
+		conds[i] = clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: value}
+	}
+	return clause.And(conds...), nil
+}
+
+// primaryKeyFields return the primary key fields of entity E
+func primaryKeyFields[E any](db *gorm.DB) ([]*schema.Field, error) {
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return nil, err
+	}
+	if len(entitySchema.PrimaryFields) == 0 {
+		return nil, fmt.Errorf("%s has no primary key", entitySchema.Name)
+	}
+	return entitySchema.PrimaryFields, nil
+}
+
+// primaryKeyValues split key into the values of the primary key fields
+func primaryKeyValues(db *gorm.DB, fields []*schema.Field, key interface{}) ([]interface{}, error) {
+	keyValue := reflect.ValueOf(key)
+	if !isKeyStruct(keyValue) {
+		if len(fields) > 1 {
+			return nil, fmt.Errorf("composite primary key (%s) requires a key struct, got %T", primaryKeyColumns(fields), key)
+		}
+		return []interface{}{key}, nil
+	}
+
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		value := keyValue.FieldByName(field.Name)
+		if !value.IsValid() {
+			// Fall back on the column name, for key structs with other field names
+			for j := 0; j < keyValue.NumField(); j++ {
+				if db.NamingStrategy.ColumnName("", keyValue.Type().Field(j).Name) == field.DBName {
+					value = keyValue.Field(j)
+					break
+				}
+			}
+		}
+		if !value.IsValid() {
+			return nil, fmt.Errorf("key %T has no field for primary key column %s", key, field.DBName)
+		}
+		values[i] = value.Interface()
+	}
+	return values, nil
+}
+
+// isKeyStruct report whether a key is a struct of primary key values,
+// rather than a single value like time.Time or a sql.Null type
+func isKeyStruct(value reflect.Value) bool {
+	if value.Kind() != reflect.Struct {
+		return false
+	}
+	if _, ok := value.Interface().(driver.Valuer); ok {
+		return false
+	}
+	return !reflect.PointerTo(value.Type()).Implements(reflect.TypeOf((*driver.Valuer)(nil)).Elem()) &&
+		value.Type().PkgPath() != "time"
+}
+
+// primaryKeyColumns list the primary key columns, for error messages
+func primaryKeyColumns(fields []*schema.Field) string {
+	columns := make([]string, len(fields))
+	for i, field := range fields {
+		columns[i] = field.DBName
+	}
+	return strings.Join(columns, ", ")
+}
@@ -0,0 +1,115 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LockStrength is the row lock taken by a locking read
+type LockStrength string
+
+const (
+	LockForUpdate      LockStrength = "UPDATE"        // exclusive lock, for rows about to be updated or deleted
+	LockForNoKeyUpdate LockStrength = "NO KEY UPDATE" // like FOR UPDATE but does not block inserts referencing the row
+	LockForShare       LockStrength = "SHARE"         // shared lock, blocks writers
+	LockForKeyShare    LockStrength = "KEY SHARE"     // weakest lock, only blocks key changes and deletes
+)
+
+// LockWait decide what a locking read does when rows are locked by another transaction
+type LockWait string
+
+const (
+	LockWaitBlock  LockWait = ""            // wait until the rows are released
+	LockNoWait     LockWait = "NOWAIT"      // fail at once with ErrLockNotAvailable
+	LockSkipLocked LockWait = "SKIP LOCKED" // skip locked rows
+)
+
+// Lock is the locking clause added to a read. The zero value takes no lock
+type Lock struct {
+	Strength LockStrength
+	Wait     LockWait
+}
+
+// Transaction run fn inside a database transaction on the default database,
+// it is committed if fn return nil and rolled back otherwise. When ctx is marked with
+// MarkIdempotent, the transaction is retried following the retry policy
+func Transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	if !Connected {
+		return ErrNotConnected
+	}
+	return transaction(ctx, "Transaction", false, fn)
+}
+
+// WithLock make the query lock the rows it reads. Locks are held until the end of the transaction,
+// so the query must be created with a transaction: NewQuery[M, E](tx). Reading with a lock
+// outside a transaction, or with a Wait mode but no Strength, fail with an error
+func (query *SQLQuery[M, E]) WithLock(lock Lock) *SQLQuery[M, E] {
+	query.lock = lock
+	return query
+}
+
+// findDB return the query's db with its locking clause, if any. An invalid lock is set
+// as the error of the returned db
+func (query *SQLQuery[M, E]) findDB() *gorm.DB {
+	if query.lock == (Lock{}) {
+		return query.db
+	}
+	db := query.db.Session(&gorm.Session{})
+	if err := validateLock(db, query.lock); err != nil {
+		db.AddError(err)
+		return db
+	}
+	return db.Clauses(lockingClause(query.lock))
+}
+
+// ReadItemByIDWithLock read an item by ID inside transaction tx, locking its row,
+// then map result into dto (data transfer object), accepts generic types
+//
+// It return read dto and error, ErrLockNotAvailable or ErrDeadlock when the lock can not be taken
+func ReadItemByIDWithLock[M any, E any, K comparable](tx *gorm.DB, id K, lock Lock) (dto M, err error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return dto, err
+	}
+	if err := validateLock(tx, lock); err != nil {
+		return dto, err
+	}
+
+	var item E
+	db := tx
+	if lock.Strength != "" {
+		db = db.Clauses(lockingClause(lock))
+	}
+	if err := db.Where(cond).First(&item).Error; err != nil {
+		return dto, dbError(err)
+	}
+
+	// Mapping from entity model to DTO model
+	if err := MapToDTO(&dto, item); err != nil {
+		return dto, err
+	}
+	return dto, nil
+}
+
+// validateLock check that lock can be taken with db: inside a transaction, with a strength
+// for its wait mode
+func validateLock(db *gorm.DB, lock Lock) error {
+	if lock.Wait != LockWaitBlock && lock.Strength == "" {
+		return fmt.Errorf("lock wait mode %s requires a lock strength", lock.Wait)
+	}
+	if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); !ok {
+		return errors.New("locking read requires a transaction")
+	}
+	return nil
+}
+
+func lockingClause(lock Lock) clause.Locking {
+	return clause.Locking{Strength: string(lock.Strength), Options: string(lock.Wait)}
+}
@@ -0,0 +1,65 @@
+package reposity
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type lockItem struct {
+	ID   int64 `gorm:"primaryKey"`
+	Name string
+}
+
+// fakeTx is a connection pool seen as a transaction, for statements built in dry run
+type fakeTx struct {
+	gorm.ConnPool
+}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+func TestQueryFindDBLock(t *testing.T) {
+	db := newTestDB(t).Session(&gorm.Session{DryRun: true})
+	tx := db.WithContext(context.Background())
+	tx.Statement.ConnPool = fakeTx{}
+
+	tests := []struct {
+		name    string
+		db      *gorm.DB
+		lock    Lock
+		wantSQL string
+		wantErr string
+	}{
+		{name: "no lock", db: db, wantSQL: `SELECT * FROM "lock_items"`},
+		{name: "lock in transaction", db: tx, lock: Lock{Strength: LockForUpdate, Wait: LockNoWait}, wantSQL: `SELECT * FROM "lock_items" FOR UPDATE NOWAIT`},
+		{name: "lock outside transaction", db: db, lock: Lock{Strength: LockForShare}, wantErr: "requires a transaction"},
+		{name: "wait without strength", db: tx, lock: Lock{Wait: LockSkipLocked}, wantErr: "requires a lock strength"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := NewQuery[lockItem, lockItem](tt.db).WithLock(tt.lock)
+			var items []lockItem
+			result := query.findDB().Find(&items)
+			if tt.wantErr != "" {
+				if result.Error == nil || !strings.Contains(result.Error.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", result.Error, tt.wantErr)
+				}
+				return
+			}
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			if sql := result.Statement.SQL.String(); sql != tt.wantSQL {
+				t.Errorf("SQL = %s, want %s", sql, tt.wantSQL)
+			}
+		})
+	}
+
+	// The error of an invalid lock stays with the query, not with the db it was created with
+	if db.Error != nil {
+		t.Errorf("db.Error = %v", db.Error)
+	}
+}
@@ -0,0 +1,373 @@
+package reposity
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Mapper convert between a dto (data transfer object) M and an entity E. All helpers map through
+// the Mapper registered for their type pair, or the default reflective one
+type Mapper[M any, E any] interface {
+	ToEntity(dst *E, src M) error
+	ToDTO(dst *M, src E) error
+}
+
+// mapperKey identify a registered Mapper by its type pair
+type mapperKey struct {
+	dto, entity reflect.Type
+}
+
+// mappers hold the registered mappers, as Mapper[M, E] values
+var mappers sync.Map
+
+// RegisterMapper make the helpers use mapper for the type pair M, E, for instance
+// the reflection-free mapper generated by reposity/cmd/mapgen
+func RegisterMapper[M any, E any](mapper Mapper[M, E]) {
+	mappers.Store(mapperKey{reflect.TypeOf((*M)(nil)).Elem(), reflect.TypeOf((*E)(nil)).Elem()}, mapper)
+}
+
+// MapperFor return the Mapper used for the type pair M, E
+func MapperFor[M any, E any]() Mapper[M, E] {
+	if mapper, ok := mappers.Load(mapperKey{reflect.TypeOf((*M)(nil)).Elem(), reflect.TypeOf((*E)(nil)).Elem()}); ok {
+		return mapper.(Mapper[M, E])
+	}
+	return planMapper[M, E]{converters: defaultConverters}
+}
+
+// NewMapper return a default Mapper using converters, and the global converters for
+// pairs it does not know. Register it with RegisterMapper to give a repository its own conversions
+func NewMapper[M any, E any](converters *Converters) Mapper[M, E] {
+	return planMapper[M, E]{converters: converters}
+}
+
+// MapToDTO map an entity into its dto (data transfer object) with the Mapper of the type pair
+func MapToDTO[M any, E any](dst *M, src E) error {
+	return MapperFor[M, E]().ToDTO(dst, src)
+}
+
+// MapToEntity map a dto (data transfer object) into its entity with the Mapper of the type pair
+func MapToEntity[M any, E any](dst *E, src M) error {
+	return MapperFor[M, E]().ToEntity(dst, src)
+}
+
+// MapValue map src into dst (a pointer) with the cached field plans of the default mapper.
+// Fields are matched by name, fields of embedded structs are flattened, nil pointers and invalid
+// sql.Null* values in src leave dst unchanged, and fields tagged `dto:"ignore"` are skipped.
+//
+// It replaced github.com/dranikpg/dto-mapper and keeps its results, except:
+//   - an integer is not mapped to a string, dto-mapper produced the rune of the number
+//   - a field hides the fields of the same name in embedded structs, with dto-mapper the last one won
+//   - unexported fields are skipped instead of panicking, embedded struct pointers are mapped as fields, not flattened
+//   - a map of slices is not flattened into a slice
+//   - inspect and conversion funcs are replaced by Converters, see RegisterConverter
+//   - sql.Null* and driver.Valuer values are supported
+func MapValue(dst interface{}, src interface{}) error {
+	return defaultConverters.mapValue(dst, src)
+}
+
+// mapValue map src into dst with the plans of converters
+func (converters *Converters) mapValue(dst interface{}, src interface{}) error {
+	dstValue := reflect.ValueOf(dst)
+	if dstValue.Kind() != reflect.Pointer || dstValue.IsNil() {
+		return fmt.Errorf("map destination must be a non-nil pointer, got %T", dst)
+	}
+	srcValue := reflect.ValueOf(src)
+	if !srcValue.IsValid() {
+		return nil
+	}
+	return converters.planCache().plan(dstValue.Type().Elem(), srcValue.Type())(dstValue.Elem(), srcValue)
+}
+
+// planMapper is the default Mapper, backed by the cached field plans
+type planMapper[M any, E any] struct {
+	converters *Converters
+}
+
+func (mapper planMapper[M, E]) ToEntity(dst *E, src M) error {
+	return mapper.converters.mapValue(dst, src)
+}
+
+func (mapper planMapper[M, E]) ToDTO(dst *M, src E) error {
+	return mapper.converters.mapValue(dst, src)
+}
+
+// mapFunc copy src into dst, dst is addressable
+type mapFunc func(dst, src reflect.Value) error
+
+// planKey identify a compiled plan by its destination and source types
+type planKey struct {
+	dst, src reflect.Type
+}
+
+// planCache hold the plans compiled with a converters registry, it is replaced when converters change
+type planCache struct {
+	converters *Converters
+	generation uint64
+	plans      sync.Map // planKey -> mapFunc
+	mu         sync.Mutex
+	// compiling hold plans being compiled, so recursive types refer to themselves
+	compiling map[planKey]*mapFunc
+}
+
+// plan return the compiled plan mapping src values into dst values
+func (cache *planCache) plan(dst, src reflect.Type) mapFunc {
+	key := planKey{dst, src}
+	if plan, ok := cache.plans.Load(key); ok {
+		return plan.(mapFunc)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.compile(key)
+}
+
+// compile build a plan, cache.mu must be held
+func (cache *planCache) compile(key planKey) mapFunc {
+	if plan, ok := cache.plans.Load(key); ok {
+		return plan.(mapFunc)
+	}
+	if plan, ok := cache.compiling[key]; ok {
+		// Recursive type: call the plan once it is compiled
+		return func(dst, src reflect.Value) error {
+			return (*plan)(dst, src)
+		}
+	}
+
+	plan := new(mapFunc)
+	cache.compiling[key] = plan
+	*plan = cache.build(key.dst, key.src)
+	delete(cache.compiling, key)
+	cache.plans.Store(key, *plan)
+	return *plan
+}
+
+// build choose how to map src into dst: registered converters, then in the order used by
+// dto-mapper assignment, conversion and pointers, then driver values, nullable values,
+// structs, slices and maps
+func (cache *planCache) build(dst, src reflect.Type) mapFunc {
+	if convert, ok := cache.converters.lookup(planKey{dst, src}); ok {
+		return convert
+	}
+
+	switch {
+	case src.AssignableTo(dst):
+		return func(dstValue, srcValue reflect.Value) error {
+			dstValue.Set(srcValue)
+			return nil
+		}
+
+	case convertible(dst, src):
+		return func(dstValue, srcValue reflect.Value) error {
+			dstValue.Set(srcValue.Convert(dst))
+			return nil
+		}
+
+	case src.Kind() == reflect.Pointer:
+		elem := cache.compile(planKey{dst, src.Elem()})
+		return func(dstValue, srcValue reflect.Value) error {
+			// Skip null pointers
+			if srcValue.IsNil() {
+				return nil
+			}
+			return elem(dstValue, srcValue.Elem())
+		}
+
+	case dst.Kind() == reflect.Pointer:
+		elem := cache.compile(planKey{dst.Elem(), src})
+		isNull := isNullPlan(src)
+		return func(dstValue, srcValue reflect.Value) error {
+			// Null values do not allocate the pointer
+			if isNull != nil && isNull(srcValue) {
+				return nil
+			}
+			if dstValue.IsNil() {
+				dstValue.Set(reflect.New(dst.Elem()))
+			}
+			return elem(dstValue.Elem(), srcValue)
+		}
+	}
+
+	// Values of database types, like pgtype or decimal types
+	if plan, ok := cache.driverValuePlan(dst, src); ok {
+		return plan
+	}
+
+	// sql.Null* like values: {value, Valid bool}
+	if valueIndex, ok := nullableValue(src); ok {
+		elem := cache.compile(planKey{dst, src.Field(valueIndex).Type})
+		validIndex := 1 - valueIndex
+		return func(dstValue, srcValue reflect.Value) error {
+			if !srcValue.Field(validIndex).Bool() {
+				return nil
+			}
+			return elem(dstValue, srcValue.Field(valueIndex))
+		}
+	}
+	if valueIndex, ok := nullableValue(dst); ok {
+		elem := cache.compile(planKey{dst.Field(valueIndex).Type, src})
+		validIndex := 1 - valueIndex
+		return func(dstValue, srcValue reflect.Value) error {
+			if err := elem(dstValue.Field(valueIndex), srcValue); err != nil {
+				return err
+			}
+			dstValue.Field(validIndex).SetBool(true)
+			return nil
+		}
+	}
+
+	switch {
+	case dst.Kind() == reflect.Struct && src.Kind() == reflect.Struct:
+		return cache.structPlan(dst, src)
+
+	case dst.Kind() == reflect.Slice && src.Kind() == reflect.Slice:
+		elem := cache.compile(planKey{dst.Elem(), src.Elem()})
+		return func(dstValue, srcValue reflect.Value) error {
+			dstValue.Set(reflect.MakeSlice(dst, srcValue.Len(), srcValue.Len()))
+			for i := 0; i < srcValue.Len(); i++ {
+				if err := elem(dstValue.Index(i), srcValue.Index(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+	case dst.Kind() == reflect.Map && src.Kind() == reflect.Map:
+		key := cache.compile(planKey{dst.Key(), src.Key()})
+		elem := cache.compile(planKey{dst.Elem(), src.Elem()})
+		return func(dstValue, srcValue reflect.Value) error {
+			dstValue.Set(reflect.MakeMapWithSize(dst, srcValue.Len()))
+			iter := srcValue.MapRange()
+			for iter.Next() {
+				k := reflect.New(dst.Key()).Elem()
+				v := reflect.New(dst.Elem()).Elem()
+				if err := key(k, iter.Key()); err != nil {
+					return err
+				}
+				if err := elem(v, iter.Value()); err != nil {
+					return err
+				}
+				dstValue.SetMapIndex(k, v)
+			}
+			return nil
+		}
+
+	case dst.Kind() == reflect.Slice && src.Kind() == reflect.Map:
+		elem := cache.compile(planKey{dst.Elem(), src.Elem()})
+		return func(dstValue, srcValue reflect.Value) error {
+			dstValue.Set(reflect.MakeSlice(dst, srcValue.Len(), srcValue.Len()))
+			iter := srcValue.MapRange()
+			for i := 0; iter.Next(); i++ {
+				if err := elem(dstValue.Index(i), iter.Value()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	err := fmt.Errorf("no valid mapping found for %v from %v", dst, src)
+	return func(dstValue, srcValue reflect.Value) error {
+		return err
+	}
+}
+
+// fieldPlan map one field of a struct plan
+type fieldPlan struct {
+	dst, src []int
+	plan     mapFunc
+}
+
+// structPlan map the fields with the same name, embedded structs are flattened
+func (cache *planCache) structPlan(dst, src reflect.Type) mapFunc {
+	srcFields := map[string][]int{}
+	for _, field := range mappedFields(src, nil) {
+		srcFields[field.Name] = field.Index
+	}
+
+	var fields []fieldPlan
+	for _, field := range mappedFields(dst, nil) {
+		srcIndex, ok := srcFields[field.Name]
+		if !ok {
+			continue
+		}
+		fields = append(fields, fieldPlan{
+			dst:  field.Index,
+			src:  srcIndex,
+			plan: cache.compile(planKey{field.Type, src.FieldByIndex(srcIndex).Type}),
+		})
+	}
+
+	return func(dstValue, srcValue reflect.Value) error {
+		for _, field := range fields {
+			if err := field.plan(dstValue.FieldByIndex(field.dst), srcValue.FieldByIndex(field.src)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// mappedFields list the exported fields of t by name, flattening embedded structs.
+// A field hides the fields of the same name found deeper in embedded structs
+func mappedFields(t reflect.Type, index []int) []reflect.StructField {
+	var fields, embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if tag, ok := field.Tag.Lookup("dto"); ok && strings.Contains(tag, "ignore") {
+			continue
+		}
+		field.Index = append(append([]int{}, index...), i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, mappedFields(field.Type, field.Index)...)
+			continue
+		}
+		if field.IsExported() {
+			fields = append(fields, field)
+		}
+	}
+
+	seen := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		seen[field.Name] = true
+	}
+	for _, field := range embedded {
+		if !seen[field.Name] {
+			seen[field.Name] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// convertible report whether src converts to dst with a Go conversion, excluding the
+// integer to string conversion which produces a rune instead of the number
+func convertible(dst, src reflect.Type) bool {
+	if !src.ConvertibleTo(dst) {
+		return false
+	}
+	if dst.Kind() == reflect.String && src.Kind() != reflect.String && src.Kind() != reflect.Slice {
+		return false
+	}
+	// Slice to array conversions panic when the lengths differ
+	if src.Kind() == reflect.Slice && (dst.Kind() == reflect.Array || dst.Kind() == reflect.Pointer) {
+		return false
+	}
+	return true
+}
+
+// nullableValue detect sql.Null* like structs: two fields, a value and a Valid bool.
+// It return the index of the value field
+func nullableValue(t reflect.Type) (int, bool) {
+	if t.Kind() != reflect.Struct || t.NumField() != 2 {
+		return 0, false
+	}
+	for i := 0; i < 2; i++ {
+		field := t.Field(i)
+		if field.Name == "Valid" && field.Type.Kind() == reflect.Bool && t.Field(1-i).IsExported() {
+			return 1 - i, true
+		}
+	}
+	return 0, false
+}
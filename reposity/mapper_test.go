@@ -0,0 +1,184 @@
+package reposity
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	dtoMapper "github.com/dranikpg/dto-mapper"
+)
+
+type mapperBase struct {
+	ID        int64
+	CreatedAt time.Time
+}
+
+type mapperAddress struct {
+	City    string
+	Country string
+}
+
+type mapperStatus string
+
+type mapperEntity struct {
+	mapperBase
+	Name     string
+	Nick     *string
+	Age      int32
+	Status   mapperStatus
+	Address  mapperAddress
+	Tags     []string
+	Scores   map[string]int
+	Password string
+}
+
+type mapperAddressDTO struct {
+	City string
+}
+
+type mapperDTO struct {
+	ID        int64
+	CreatedAt time.Time
+	Name      string
+	Nick      string
+	Age       *int64
+	Status    string
+	Address   *mapperAddressDTO
+	Tags      []string
+	Scores    map[string]int
+	Password  string `dto:"ignore"`
+}
+
+// TestPlanMapperMatchDTOMapper check the default mapper against dto-mapper, which it replaced
+func TestPlanMapperMatchDTOMapper(t *testing.T) {
+	nick := "bob"
+	age := int64(42)
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	entity := mapperEntity{
+		mapperBase: mapperBase{ID: 7, CreatedAt: created},
+		Name:       "Bob",
+		Nick:       &nick,
+		Age:        42,
+		Status:     "active",
+		Address:    mapperAddress{City: "Hanoi", Country: "VN"},
+		Tags:       []string{"a", "b"},
+		Scores:     map[string]int{"go": 3},
+		Password:   "secret",
+	}
+	dto := mapperDTO{
+		ID:        7,
+		CreatedAt: created,
+		Name:      "Bob",
+		Nick:      "bob",
+		Age:       &age,
+		Status:    "active",
+		Address:   &mapperAddressDTO{City: "Hanoi"},
+		Tags:      []string{"a"},
+		Scores:    map[string]int{"go": 3},
+		Password:  "ignored",
+	}
+
+	tests := []struct {
+		name string
+		dst  func() interface{} // pointer to a fresh destination
+		src  interface{}
+	}{
+		{"entity to dto", func() interface{} { return &mapperDTO{} }, entity},
+		{"dto to entity", func() interface{} { return &mapperEntity{} }, dto},
+		{"dto over stored entity", func() interface{} {
+			stored := entity
+			stored.Nick = nil
+			return &stored
+		}, dto},
+		{"nil pointers", func() interface{} { return &mapperEntity{Name: "kept"} }, mapperDTO{Name: "Bob"}},
+		{"slice of structs", func() interface{} { return &[]mapperDTO{} }, []mapperEntity{entity, {Name: "Alice"}}},
+		{"pointer to value", func() interface{} { return new(int64) }, &age},
+		{"value to pointer", func() interface{} { return new(*int32) }, age},
+		{"numeric conversion", func() interface{} { return new(float64) }, int32(3)},
+		{"named string", func() interface{} { return new(mapperStatus) }, "active"},
+		{"bytes to string", func() interface{} { return new(string) }, []byte("abc")},
+		{"map to slice", func() interface{} { return &[]int{} }, map[string]int{"a": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.dst()
+			if err := dtoMapper.Map(want, tt.src); err != nil {
+				t.Fatalf("dto-mapper: %v", err)
+			}
+			got := tt.dst()
+			if err := MapValue(got, tt.src); err != nil {
+				t.Fatalf("MapValue: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("MapValue = %+v, dto-mapper = %+v", reflect.ValueOf(got).Elem(), reflect.ValueOf(want).Elem())
+			}
+		})
+	}
+}
+
+type mapperShadowInner struct {
+	Name string
+}
+
+type mapperShadow struct {
+	Name string
+	mapperShadowInner
+}
+
+type mapperNameDTO struct {
+	Name string
+}
+
+type mapperNumbers struct {
+	Values map[string][]int
+}
+
+type mapperFlat struct {
+	Values []int
+}
+
+// TestPlanMapperIncompatibilities check the documented differences with dto-mapper
+func TestPlanMapperIncompatibilities(t *testing.T) {
+	t.Run("integer to string", func(t *testing.T) {
+		var old, got string
+		if err := dtoMapper.Map(&old, 65); err != nil || old != "A" {
+			t.Fatalf("dto-mapper = %q, %v", old, err)
+		}
+		if err := MapValue(&got, 65); err == nil {
+			t.Errorf("MapValue = %q, want an error", got)
+		}
+	})
+
+	t.Run("embedded field precedence", func(t *testing.T) {
+		src := mapperShadow{Name: "outer", mapperShadowInner: mapperShadowInner{Name: "inner"}}
+		var old, got mapperNameDTO
+		if err := dtoMapper.Map(&old, src); err != nil || old.Name != "inner" {
+			t.Fatalf("dto-mapper = %q, %v", old.Name, err)
+		}
+		if err := MapValue(&got, src); err != nil || got.Name != "outer" {
+			t.Errorf("MapValue = %q, %v, want outer", got.Name, err)
+		}
+	})
+
+	t.Run("map of slices to slice", func(t *testing.T) {
+		src := mapperNumbers{Values: map[string][]int{"a": {1, 2}}}
+		var old, got mapperFlat
+		if err := dtoMapper.Map(&old, src); err != nil || len(old.Values) != 2 {
+			t.Fatalf("dto-mapper = %v, %v", old.Values, err)
+		}
+		if err := MapValue(&got, src); err == nil {
+			t.Errorf("MapValue = %v, want an error", got.Values)
+		}
+	})
+
+	t.Run("sql null values", func(t *testing.T) {
+		var old, got string
+		if err := dtoMapper.Map(&old, sql.NullString{String: "a", Valid: true}); err == nil {
+			t.Fatal("dto-mapper mapped sql.NullString")
+		}
+		if err := MapValue(&got, sql.NullString{String: "a", Valid: true}); err != nil || got != "a" {
+			t.Errorf("MapValue = %q, %v, want a", got, err)
+		}
+	})
+}
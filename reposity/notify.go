@@ -0,0 +1,236 @@
+package reposity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// ChangeOp is the kind of row change reported by Subscribe
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "INSERT"
+	ChangeUpdate ChangeOp = "UPDATE"
+	ChangeDelete ChangeOp = "DELETE"
+	// ChangeResync is sent after the listener reconnected, changes made while it was
+	// disconnected are lost so caches should be flushed
+	ChangeResync ChangeOp = "RESYNC"
+)
+
+// ChangeEvent is a row change of entity E notified by the trigger installed with InstallChangeTrigger
+type ChangeEvent[E any] struct {
+	Table string   `json:"table"` // schema qualified table name, e.g. public.users
+	Op    ChangeOp `json:"op"`
+	ID    string   `json:"id"` // primary key of the changed row, empty for ChangeResync
+	// Item has only its primary key set from ID, read the item to get the other fields
+	Item E `json:"-"`
+}
+
+// changeTriggerName is the name of the trigger and of its function
+const changeTriggerName = "reposity_notify_change"
+
+// InstallChangeTrigger create (or replace) a trigger on the table of entity E which
+// notifies inserted, updated and deleted rows to Subscribe[E], accepts generic types.
+// Entities with a composite primary key are not supported
+func InstallChangeTrigger[E any]() error {
+	if !Connected {
+		return ErrNotConnected
+	}
+	entitySchema, err := parseEntitySchema[E](defaultDB)
+	if err != nil {
+		return err
+	}
+	keyField, err := changeKeyField(entitySchema)
+	if err != nil {
+		return err
+	}
+
+	function := changeTriggerName
+	if i := strings.LastIndex(entitySchema.Table, "."); i >= 0 {
+		function = entitySchema.Table[:i+1] + changeTriggerName
+	}
+	quote := defaultDB.Statement.Quote
+
+	return dbError(defaultDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify(TG_ARGV[0], json_build_object(
+		'table', TG_TABLE_SCHEMA || '.' || TG_TABLE_NAME,
+		'op', TG_OP,
+		'id', CASE WHEN TG_OP = 'DELETE' THEN to_jsonb(OLD) ->> TG_ARGV[1] ELSE to_jsonb(NEW) ->> TG_ARGV[1] END
+	)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`, quote(function))).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf(`DROP TRIGGER IF EXISTS %s ON %s`,
+			quote(changeTriggerName), quote(entitySchema.Table))).Error; err != nil {
+			return err
+		}
+		return tx.Exec(fmt.Sprintf(`CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s
+			FOR EACH ROW EXECUTE FUNCTION %s(%s, %s)`,
+			quote(changeTriggerName), quote(entitySchema.Table), quote(function),
+			quoteLiteral(changeChannel(entitySchema)), quoteLiteral(keyField.DBName))).Error
+	}))
+}
+
+// Subscribe listen for changes of the table of entity E and call handler for each of them,
+// until ctx is canceled, accepts generic types. It uses a dedicated connection, which is
+// reopened with backoff after a connection loss, then handler receives a ChangeResync event.
+// errs receive the errors of the subscription (connection loss, invalid notification), without
+// blocking: errors are dropped when errs is full or nil
+//
+// It return nil when ctx is canceled, or error if the first connection fails
+// or the entity has a composite primary key
+func Subscribe[E any](ctx context.Context, handler func(ctx context.Context, event ChangeEvent[E]), errs chan<- error) error {
+	if !Connected {
+		return ErrNotConnected
+	}
+	entitySchema, err := parseEntitySchema[E](defaultDB)
+	if err != nil {
+		return err
+	}
+	if _, err := changeKeyField(entitySchema); err != nil {
+		return err
+	}
+	channel := changeChannel(entitySchema)
+
+	// ChangeResync carries the table name in the form of the trigger's events
+	table, err := qualifiedTable(defaultDB.WithContext(ctx), entitySchema)
+	if err != nil {
+		return err
+	}
+
+	conn, err := listen(ctx, channel)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for {
+		// Returns when the connection is lost or ctx is canceled
+		err := dispatchNotifications(ctx, conn, entitySchema, handler, errs)
+		conn.Close(context.Background())
+		if ctx.Err() != nil {
+			return nil
+		}
+		reportError(errs, fmt.Errorf("listen %s: %w", channel, err))
+
+		// Reconnect until it works, then tell handler that changes may have been missed
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			var err error
+			if conn, err = listen(ctx, channel); err == nil {
+				break
+			}
+			reportError(errs, fmt.Errorf("listen %s: %w", channel, err))
+			backoff = min(backoff*2, 30*time.Second)
+		}
+		backoff = time.Second
+		handler(ctx, ChangeEvent[E]{Table: table, Op: ChangeResync})
+	}
+}
+
+// changeKeyField return the primary key field sent in change events,
+// error if the entity has none or a composite primary key
+func changeKeyField(s *schema.Schema) (*schema.Field, error) {
+	if len(s.PrimaryFields) > 1 {
+		return nil, fmt.Errorf("%s has a composite primary key, change notifications need a single column key", s.Name)
+	}
+	if s.PrioritizedPrimaryField == nil {
+		return nil, fmt.Errorf("%s has no primary key", s.Name)
+	}
+	return s.PrioritizedPrimaryField, nil
+}
+
+// qualifiedTable resolve the table of s to schema.table like TG_TABLE_SCHEMA || '.' || TG_TABLE_NAME,
+// unqualified names are looked up in the search path
+func qualifiedTable(db *gorm.DB, s *schema.Schema) (string, error) {
+	var table string
+	err := db.Raw(`SELECT n.nspname || '.' || c.relname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = to_regclass(?)`,
+		db.Statement.Quote(s.Table)).Scan(&table).Error
+	if err != nil {
+		return "", dbError(err)
+	}
+	if table == "" {
+		return "", fmt.Errorf("table %s does not exist", s.Table)
+	}
+	return table, nil
+}
+
+// listen open a dedicated connection and LISTEN on channel
+func listen(ctx context.Context, channel string) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, defaultDSN)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dispatchNotifications wait for notifications and pass them to handler until the connection fails.
+// Invalid notifications are reported to errs and skipped
+func dispatchNotifications[E any](ctx context.Context, conn *pgx.Conn, s *schema.Schema, handler func(ctx context.Context, event ChangeEvent[E]), errs chan<- error) error {
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		event, err := decodeChangeEvent[E](ctx, s, notification.Payload)
+		if err != nil {
+			reportError(errs, err)
+			continue
+		}
+		handler(ctx, event)
+	}
+}
+
+// decodeChangeEvent decode the payload of a change notification, the primary key of the
+// event's item is set from its ID
+func decodeChangeEvent[E any](ctx context.Context, s *schema.Schema, payload string) (ChangeEvent[E], error) {
+	var event ChangeEvent[E]
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return event, fmt.Errorf("invalid change notification %q: %w", payload, err)
+	}
+	if field := s.PrioritizedPrimaryField; field != nil {
+		if err := field.Set(ctx, reflect.ValueOf(&event.Item).Elem(), event.ID); err != nil {
+			return event, fmt.Errorf("invalid change notification %q: %w", payload, err)
+		}
+	}
+	return event, nil
+}
+
+// reportError send err to errs without blocking
+func reportError(errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+// changeChannel return the notification channel of a table
+func changeChannel(s *schema.Schema) string {
+	channel := "reposity_" + strings.ReplaceAll(s.Table, ".", "_")
+	// Postgres truncates identifiers to 63 bytes
+	if len(channel) > 63 {
+		channel = channel[:63]
+	}
+	return channel
+}
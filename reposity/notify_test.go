@@ -0,0 +1,73 @@
+package reposity
+
+import (
+	"context"
+	"testing"
+)
+
+type notifyItem struct {
+	ID   int64 `gorm:"primaryKey"`
+	Name string
+}
+
+func TestDecodeChangeEvent(t *testing.T) {
+	db := newTestDB(t)
+	entitySchema, err := parseEntitySchema[notifyItem](db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := decodeChangeEvent[notifyItem](context.Background(), entitySchema, `{"table":"notify_items","op":"UPDATE","id":"42"}`)
+	if err != nil {
+		t.Fatalf("decodeChangeEvent: %v", err)
+	}
+	want := ChangeEvent[notifyItem]{Table: "notify_items", Op: ChangeUpdate, ID: "42", Item: notifyItem{ID: 42}}
+	if event != want {
+		t.Errorf("decodeChangeEvent = %+v, want %+v", event, want)
+	}
+
+	for _, payload := range []string{`not json`, `{"table":"notify_items","op":"DELETE","id":"abc"}`} {
+		if event, err := decodeChangeEvent[notifyItem](context.Background(), entitySchema, payload); err == nil {
+			t.Errorf("decodeChangeEvent(%s) = %+v, want an error", payload, event)
+		}
+	}
+}
+
+func TestReportErrorDoNotBlock(t *testing.T) {
+	errs := make(chan error, 1)
+	reportError(errs, context.Canceled)
+	reportError(errs, context.DeadlineExceeded)
+	reportError(nil, context.Canceled)
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("first error = %v", err)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error %v, errs was full", err)
+	default:
+	}
+}
+
+type notifyPair struct {
+	LeftID  int64 `gorm:"primaryKey"`
+	RightID int64 `gorm:"primaryKey"`
+}
+
+func TestChangeKeyField(t *testing.T) {
+	db := newTestDB(t)
+	itemSchema, err := parseEntitySchema[notifyItem](db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field, err := changeKeyField(itemSchema); err != nil || field.DBName != "id" {
+		t.Errorf("changeKeyField(notifyItem) = %v, %v, want id", field, err)
+	}
+
+	pairSchema, err := parseEntitySchema[notifyPair](db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field, err := changeKeyField(pairSchema); err == nil {
+		t.Errorf("changeKeyField(notifyPair) = %s, want a composite key error", field.DBName)
+	}
+}
@@ -0,0 +1,260 @@
+package reposity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OutboxEvent is a domain event stored in the outbox table, written in the same transaction
+// as the data change it describes and delivered later by an OutboxRelay
+type OutboxEvent struct {
+	ID int64 `gorm:"primaryKey;index:idx_outbox_event_order,priority:2"` // delivery order within a transaction
+	// TxID is the transaction which wrote the event, set by the database (Postgres 13 or later).
+	// Transaction IDs are assigned at the first write of a transaction, not at commit, so TxID order
+	// is not commit order: a transaction may commit after a later one, even one which waited for
+	// its row locks. Events are only delivered once every transaction with a lower TxID has ended
+	TxID        uint64          `gorm:"type:xid8;not null;default:pg_current_xact_id();index:idx_outbox_event_order,priority:1"`
+	Topic       string          `gorm:"not null"`
+	Type        string          `gorm:"not null"`
+	Key         string          // aggregate ID, usable as partition key by the publisher
+	Payload     json.RawMessage `gorm:"type:jsonb"`
+	CreatedAt   time.Time
+	DeliveredAt *time.Time `gorm:"index"`
+}
+
+// Publisher deliver outbox events to a broker. It must be safe to receive an event twice,
+// delivery is at least once
+type Publisher interface {
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+// outboxLockKey is the advisory lock held by the active relay, so events are published in order
+const outboxLockKey = 0x6f7574626f78 // "outbox"
+
+// MigrateOutbox create the outbox table
+func MigrateOutbox() error {
+	return Migrate(&OutboxEvent{})
+}
+
+// NewOutboxEvent build an event with payload encoded as JSON
+func NewOutboxEvent(topic, eventType, key string, payload interface{}) (OutboxEvent, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	return OutboxEvent{Topic: topic, Type: eventType, Key: key, Payload: data}, nil
+}
+
+// WriteOutbox add events to the outbox with tx, use it inside Transaction
+// so events are only stored when the data change commits
+func WriteOutbox(tx *gorm.DB, events ...OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return tx.Create(&events).Error
+}
+
+// CreateItemFromDTOWithEvents create item from dto (data transfer object) like CreateItemFromDTO
+// and write the events built from the created dto in the same transaction, accepts generic types
+//
+// It return created item and error
+func CreateItemFromDTOWithEvents[M any, E any](dto M, events func(created M) ([]OutboxEvent, error)) (M, error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+
+	err := transaction(context.Background(), "CreateItemFromDTOWithEvents", false, func(tx *gorm.DB) error {
+		created, err := createItemFromDTO[M, E](tx, dto)
+		if err != nil {
+			return err
+		}
+		outbox, err := events(created)
+		if err != nil {
+			return err
+		}
+		if err := WriteOutbox(tx, outbox...); err != nil {
+			return err
+		}
+		dto = created
+		return nil
+	})
+	return dto, err
+}
+
+// UpdateItemByIDFromDTOWithEvents update item by ID from dto (data transfer object) like UpdateItemByIDFromDTO
+// and write the events built from the updated dto in the same transaction, accepts generic types
+//
+// It return updated item (dto) and error
+func UpdateItemByIDFromDTOWithEvents[M any, E any, K comparable](id K, dto M, events func(updated M) ([]OutboxEvent, error)) (M, error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+
+	// dto is kept unchanged until the transaction commits, for retries
+	var updated M
+	err := transaction(context.Background(), "UpdateItemByIDFromDTOWithEvents", false, func(tx *gorm.DB) error {
+		var err error
+		updated, err = updateItemByIDFromDTO[M, E](tx, id, dto)
+		if err != nil {
+			return err
+		}
+		outbox, err := events(updated)
+		if err != nil {
+			return err
+		}
+		return WriteOutbox(tx, outbox...)
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// OutboxRelay poll the outbox and hand undelivered events to Publisher in (TxID, ID) order: the events
+// of a transaction in insert order, transactions in the order their ID was assigned, which is not
+// their commit order. No event is skipped, those of a transaction wait until every transaction with
+// a lower ID has ended, so a long running transaction delays them. Two transactions changing the same
+// item may be delivered in the opposite order of their commits, consumers needing the latest state
+// should compare a version carried in the payload. Several relays may run, an advisory lock lets
+// only one of them publish at a time
+type OutboxRelay struct {
+	Publisher       Publisher
+	BatchSize       int           // events published per poll, default 100
+	PollInterval    time.Duration // delay between polls when the outbox is empty, default 1s
+	Retention       time.Duration // delivered events older than this are deleted, default 24h
+	CleanupInterval time.Duration // delay between deletions of delivered events by Run, default 1h
+	OnError         func(error)   // called by Run when a poll fails, Run keeps retrying after PollInterval
+}
+
+// Run relay events until ctx is canceled
+func (relay *OutboxRelay) Run(ctx context.Context) {
+	pollInterval := relay.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	cleanupInterval := relay.CleanupInterval
+	if cleanupInterval <= 0 {
+		cleanupInterval = time.Hour
+	}
+
+	var lastCleanup time.Time
+	for {
+		published, err := relay.RelayOnce(ctx)
+		if err == nil && time.Since(lastCleanup) >= cleanupInterval {
+			if err = relay.Cleanup(ctx); err == nil {
+				lastCleanup = time.Now()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && relay.OnError != nil {
+			relay.OnError(err)
+		}
+
+		// Keep draining while there are events
+		if err == nil && published > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// RelayOnce publish one batch of undelivered events in (TxID, ID) order, see OutboxRelay for
+// the guarantees of this order. Publishing stops at the first failure,
+// the failed event and the ones after it are retried on the next call. No transaction is open
+// while publishing, the relay lock is held by a session of its own
+//
+// It return number of published events
+func (relay *OutboxRelay) RelayOnce(ctx context.Context) (published int, err error) {
+	if !Connected {
+		return 0, ErrNotConnected
+	}
+	batchSize := relay.BatchSize
+	if batchSize < 1 {
+		batchSize = 100
+	}
+
+	var publishErr error
+	err = defaultDB.WithContext(ctx).Connection(func(session *gorm.DB) (err error) {
+		conn := session.Session(&gorm.Session{NewDB: true})
+
+		// Another relay is publishing
+		var locked bool
+		if err := conn.Raw("SELECT pg_try_advisory_lock(?)", outboxLockKey).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		defer func() {
+			// Unlock even when ctx is canceled, the connection goes back to the pool
+			unlockCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			if unlockErr := conn.WithContext(unlockCtx).Exec("SELECT pg_advisory_unlock(?)", outboxLockKey).Error; unlockErr != nil && err == nil {
+				err = unlockErr
+			}
+		}()
+
+		// Only events of transactions with an ID lower than every running one: no event ordered
+		// before them can still be committed, so none is skipped
+		var events []OutboxEvent
+		if err := conn.Where("delivered_at IS NULL").
+			Where("tx_id < pg_snapshot_xmin(pg_current_snapshot())").
+			Order(clause.OrderBy{Columns: []clause.OrderByColumn{
+				{Column: clause.Column{Name: "tx_id"}},
+				{Column: clause.Column{Name: "id"}},
+			}}).
+			Limit(batchSize).Find(&events).Error; err != nil {
+			return err
+		}
+
+		delivered := make([]int64, 0, len(events))
+		for _, event := range events {
+			if err := relay.Publisher.Publish(ctx, event); err != nil {
+				publishErr = fmt.Errorf("publish outbox event %d: %w", event.ID, err)
+				break
+			}
+			delivered = append(delivered, event.ID)
+		}
+
+		// Published events are delivered again if this fails, delivery is at least once
+		if len(delivered) > 0 {
+			if err := conn.Model(&OutboxEvent{}).Where("id IN ?", delivered).
+				Update("delivered_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+		published = len(delivered)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Reported after marking, so events delivered before the failure are not published again
+	return published, publishErr
+}
+
+// Cleanup delete delivered events older than the retention
+func (relay *OutboxRelay) Cleanup(ctx context.Context) error {
+	if !Connected {
+		return ErrNotConnected
+	}
+	retention := relay.Retention
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+	return defaultDB.WithContext(ctx).
+		Where("delivered_at < ?", time.Now().Add(-retention)).
+		Delete(&OutboxEvent{}).Error
+}
@@ -0,0 +1,281 @@
+package reposity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UpdateItemByIDWithMask check if item ID exist in database, then update only the fields listed in paths,
+// accepts generic types. Paths are DTO field names (json tag or Go name), Google FieldMask style paths
+// such as "address.city" update the whole top-level field. Unlike UpdateItemByIDFromDTO,
+// listed fields are written even when empty, so they can be set to false, 0 or NULL
+//
+// It return updated item (dto) and error
+func UpdateItemByIDWithMask[M any, E any, K comparable](id K, dto M, paths []string) (M, error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return dto, err
+	}
+
+	fields, err := maskDTOFields(reflect.TypeOf(dto), paths)
+	if err != nil {
+		return dto, err
+	}
+
+	// Validate masked fields of dto object input
+	if err := validateItemFields[E](defaultDB, dto, cond, structPaths(reflect.TypeOf(dto), fields)); err != nil {
+		return dto, err
+	}
+
+	// dto is kept unchanged until the transaction commits, for retries
+	var updated M
+	err = transaction(context.Background(), "UpdateItemByIDWithMask", false, func(tx *gorm.DB) error {
+		var item E
+		if err := tx.Where(cond).First(&item).Error; err != nil {
+			return err
+		}
+		var err error
+		updated, err = writeItemFields(tx, cond, &item, dto, fields, true)
+		return err
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// MergePatchItemByID check if item ID exist in database, then apply a RFC 7396 JSON Merge Patch
+// document to its dto (data transfer object) representation, accepts generic types.
+// Members set to null in the patch are cleared, the result is validated before writing
+//
+// It return updated item (dto) and error
+func MergePatchItemByID[M any, E any, K comparable](id K, patch []byte) (dto M, err error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return dto, err
+	}
+
+	var patchDoc map[string]interface{}
+	if err := decodeJSON(patch, &patchDoc); err != nil {
+		return dto, fmt.Errorf("invalid merge patch: %w", err)
+	}
+	paths := make([]string, 0, len(patchDoc))
+	for key := range patchDoc {
+		paths = append(paths, key)
+	}
+	fields, err := maskDTOFields(reflect.TypeOf(dto), paths)
+	if err != nil {
+		return dto, err
+	}
+
+	// dto is only set once the transaction commits, for retries
+	var updated M
+	err = transaction(context.Background(), "MergePatchItemByID", false, func(tx *gorm.DB) error {
+		var item E
+		if err := tx.Where(cond).First(&item).Error; err != nil {
+			return err
+		}
+
+		// Mapping from entity model to DTO model, then to a JSON document
+		var current M
+		if err := MapToDTO(&current, item); err != nil {
+			return err
+		}
+		var doc interface{}
+		if err := remarshalJSON(current, &doc); err != nil {
+			return err
+		}
+
+		// Apply patch and read the result back into a fresh DTO
+		var patched M
+		if err := remarshalJSON(mergePatch(doc, patchDoc), &patched); err != nil {
+			return err
+		}
+		if err := validateItem[E](tx, patched, cond); err != nil {
+			return err
+		}
+
+		var err error
+		updated, err = writeItemFields(tx, cond, &item, patched, fields, true)
+		return err
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// ReplaceItemByIDFromDTO check if item ID exist in database, then replace it with dto (data transfer object)
+// like HTTP PUT, accepts generic types. Every DTO field is written, including empty ones,
+// except primary key and creation time
+//
+// It return updated item (dto) and error
+func ReplaceItemByIDFromDTO[M any, E any, K comparable](id K, dto M) (M, error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return dto, err
+	}
+
+	// Validate dto object input
+	if err := validateItem[E](defaultDB, dto, cond); err != nil {
+		return dto, err
+	}
+
+	// dto is kept unchanged until the transaction commits, for retries
+	var replaced M
+	err = transaction(context.Background(), "ReplaceItemByIDFromDTO", false, func(tx *gorm.DB) error {
+		var item E
+		if err := tx.Where(cond).First(&item).Error; err != nil {
+			return err
+		}
+		var err error
+		replaced, err = writeItemFields(tx, cond, &item, dto, dtoFields(reflect.TypeOf(dto)), false)
+		return err
+	})
+	if err != nil {
+		return dto, err
+	}
+	return replaced, nil
+}
+
+// writeItemFields copy the fields of dto over the loaded item and update only their columns,
+// the other fields of item keep their stored values, the update hooks of dto M run around the write.
+// cond selects the item by primary key. strict report DTO fields without entity column, otherwise they are skipped
+func writeItemFields[M any, E any](tx *gorm.DB, cond clause.Expression, item *E, dto M, fields []dtoField, strict bool) (M, error) {
+	entitySchema, err := parseEntitySchema[E](tx)
+	if err != nil {
+		return dto, err
+	}
+
+	// Mapping from DTO to a fresh entity model, empty and nil values included
+	var mapped E
+	if err := MapToEntity(&mapped, dto); err != nil {
+		return dto, err
+	}
+
+	ctx := statementContext(tx)
+	old := *item
+	itemValue := reflect.ValueOf(item).Elem()
+	mappedValue := reflect.ValueOf(&mapped).Elem()
+	dtoValue := reflect.ValueOf(dto)
+	columns := make([]string, 0, len(fields)+1)
+	for _, f := range fields {
+		field := entitySchema.LookUpField(f.Name)
+		if field == nil || field.DBName == "" {
+			if strict {
+				return dto, fmt.Errorf("field %q of %s has no column in %s", f.JSON, dtoValue.Type(), entitySchema.Name)
+			}
+			continue
+		}
+		if field.PrimaryKey || field.AutoCreateTime > 0 {
+			continue
+		}
+
+		field.ReflectValueOf(ctx, itemValue).Set(field.ReflectValueOf(ctx, mappedValue))
+		columns = append(columns, field.DBName)
+	}
+	if len(columns) == 0 {
+		return dto, errors.New("no field to update")
+	}
+	for _, field := range entitySchema.Fields {
+		if field.AutoUpdateTime > 0 && field.DBName != "" {
+			columns = append(columns, field.DBName)
+		}
+	}
+
+	// Update item between the update hooks, then map it back to a fresh DTO
+	var updated M
+	err = updateWithHooks(tx, hooksFor[M, E](), &old, &dto, item, &updated, func() error {
+		return tx.Model(item).Where(cond).Select(columns).Updates(item).Error
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// maskDTOFields resolve field mask paths to DTO fields, only the first segment of a path is used
+func maskDTOFields(t reflect.Type, paths []string) ([]dtoField, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("empty field mask")
+	}
+	names := make([]string, 0, len(paths))
+	seen := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		name := strings.SplitN(path, ".", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return selectDTOFields(t, names)
+}
+
+// structPaths return the validator namespaces (Go names joined by dots) of fields
+func structPaths(t reflect.Type, fields []dtoField) []string {
+	paths := make([]string, len(fields))
+	for i, f := range fields {
+		names := make([]string, len(f.Index))
+		current := t
+		for j, index := range f.Index {
+			sf := current.Field(index)
+			names[j] = sf.Name
+			current = sf.Type
+		}
+		paths[i] = strings.Join(names, ".")
+	}
+	return paths
+}
+
+// mergePatch apply a RFC 7396 merge patch to target and return the result
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{}, len(patchObj))
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergePatch(targetObj[key], value)
+		}
+	}
+	return targetObj
+}
+
+// decodeJSON decode data into v keeping numbers as json.Number
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// remarshalJSON convert src into dst through its JSON encoding
+func remarshalJSON(src interface{}, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(data, dst)
+}
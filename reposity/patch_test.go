@@ -0,0 +1,85 @@
+package reposity
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type patchItem struct {
+	ID     int64 `gorm:"primaryKey"`
+	Name   string
+	Active bool
+	Count  int
+	Note   *string
+}
+
+type patchItemDTO struct {
+	ID     int64   `json:"id"`
+	Name   string  `json:"name"`
+	Active bool    `json:"active"`
+	Count  int     `json:"count"`
+	Note   *string `json:"note"`
+}
+
+func TestWriteItemFieldsKeepUnmaskedFields(t *testing.T) {
+	note := "stored"
+	stored := patchItem{ID: 1, Name: "Bob", Active: true, Count: 3, Note: &note}
+
+	tests := []struct {
+		name    string
+		mask    []string
+		want    patchItemDTO
+		columns []string
+	}{
+		{
+			name:    "zero values of masked fields",
+			mask:    []string{"active", "count"},
+			want:    patchItemDTO{ID: 1, Name: "Bob", Count: 0, Note: &note},
+			columns: []string{`"active"=false`, `"count"=0`},
+		},
+		{
+			name:    "nil pointer",
+			mask:    []string{"note"},
+			want:    patchItemDTO{ID: 1, Name: "Bob", Active: true, Count: 3},
+			columns: []string{`"note"=NULL`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := stored
+			fields, err := maskDTOFields(reflect.TypeOf(patchItemDTO{}), tt.mask)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only the masked fields of the request are meant to be written
+			request := patchItemDTO{Name: "ignored"}
+			cond := clause.Eq{Column: clause.PrimaryColumn, Value: item.ID}
+			var sql string
+			db := newTestDB(t)
+			db.Callback().Update().After("gorm:update").Register("test:sql", func(db *gorm.DB) {
+				sql = db.Dialector.Explain(db.Statement.SQL.String(), db.Statement.Vars...)
+			})
+			tx := db.Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true})
+			got, err := writeItemFields(tx, cond, &item, request, fields, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.want.ID || got.Name != tt.want.Name || got.Active != tt.want.Active ||
+				got.Count != tt.want.Count || (got.Note == nil) != (tt.want.Note == nil) {
+				t.Errorf("writeItemFields = %+v, want %+v", got, tt.want)
+			}
+			for _, column := range tt.columns {
+				if !strings.Contains(sql, column) {
+					t.Errorf("SQL %s does not set %s", sql, column)
+				}
+			}
+			if strings.Contains(sql, `"name"`) {
+				t.Errorf("SQL %s writes an unmasked field", sql)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+// Package queue is a durable job queue stored in Postgres. Jobs are claimed with
+// SELECT ... FOR UPDATE SKIP LOCKED, so many workers can share one queue without a broker.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"tudh-btc-studio.io/comongo/reposity"
+)
+
+// Job status stored in the queue table
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDead    = "dead"
+)
+
+// maxErrorBackoff is the longest delay of Work before polling again after an error
+const maxErrorBackoff = 30 * time.Second
+
+// recordTimeout bound the write of a job outcome by Work, which is not canceled with the worker context
+const recordTimeout = 5 * time.Second
+
+// ErrDuplicate is returned by Enqueue when a live job with the same dedupe key already exists
+var ErrDuplicate = errors.New("job with the same dedupe key already queued")
+
+// QueueJob is a row of the queue table, shared by all queues
+type QueueJob struct {
+	ID          int64           `gorm:"primaryKey"`
+	Queue       string          `gorm:"not null;index:idx_queue_job_ready,priority:1"`
+	Status      string          `gorm:"not null;default:pending;index:idx_queue_job_ready,priority:2"`
+	Priority    int             `gorm:"not null;default:0"`
+	RunAt       time.Time       `gorm:"not null;index:idx_queue_job_ready,priority:3"`
+	Payload     json.RawMessage `gorm:"type:jsonb;not null"`
+	DedupeKey   *string
+	Attempts    int `gorm:"not null;default:0"`
+	MaxAttempts int `gorm:"not null"`
+	LockedUntil *time.Time
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Job is a claimed job with its decoded payload
+type Job[T any] struct {
+	ID          int64
+	Payload     T
+	Priority    int
+	Attempts    int // attempts including the current one
+	MaxAttempts int
+	LastError   string
+	CreatedAt   time.Time
+}
+
+// Options configure a queue. The zero value uses the defaults below
+type Options struct {
+	MaxAttempts       int           // attempts before a job is dead-lettered, default 5
+	VisibilityTimeout time.Duration // time a worker owns a claimed job, default 30s
+	BaseBackoff       time.Duration // delay before the first retry, doubled on each attempt, default 1s
+	MaxBackoff        time.Duration // maximum retry delay, default 1h
+	PollInterval      time.Duration // idle delay of Work between empty dequeues, default 1s
+	// OnError is called by Work when claiming a job or recording its outcome fails, Work keeps
+	// polling after a delay starting at PollInterval, doubled on each consecutive error up to 30s
+	OnError func(error)
+}
+
+// EnqueueOptions configure one job
+type EnqueueOptions struct {
+	Priority    int       // higher priority jobs are dequeued first
+	RunAt       time.Time // do not run before this time, default now
+	DedupeKey   string    // skip the job if a live job of the queue has the same key
+	MaxAttempts int       // override Options.MaxAttempts
+}
+
+// Stats describe the depth and age of a queue
+type Stats struct {
+	Ready          int64         // pending jobs due now
+	Scheduled      int64         // pending jobs due later
+	Running        int64         // jobs claimed by a worker
+	Dead           int64         // dead-lettered jobs
+	OldestReadyAge time.Duration // how long the oldest ready job has been waiting
+}
+
+// Queue is a named queue of jobs with payload T
+type Queue[T any] struct {
+	db    *gorm.DB
+	name  string
+	opts  Options
+	table string
+}
+
+// Migrate create the queue table and its indexes, db nil use the default reposity connection
+func Migrate(db *gorm.DB) error {
+	if db == nil {
+		db = reposity.DB()
+	}
+	if db == nil {
+		return reposity.ErrNotConnected
+	}
+	if err := db.AutoMigrate(&QueueJob{}); err != nil {
+		return err
+	}
+	table, err := tableName(db)
+	if err != nil {
+		return err
+	}
+	return db.Exec(fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS idx_queue_job_dedupe ON %s (queue, dedupe_key) WHERE %s`,
+		table, dedupeIndexPredicate)).Error
+}
+
+// dedupeIndexPredicate limit deduplication to live jobs
+const dedupeIndexPredicate = `dedupe_key IS NOT NULL AND status <> 'dead'`
+
+// New create a queue named name, db nil use the default reposity connection
+func New[T any](db *gorm.DB, name string, opts Options) (*Queue[T], error) {
+	if db == nil {
+		db = reposity.DB()
+	}
+	if db == nil {
+		return nil, reposity.ErrNotConnected
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 5
+	}
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = 30 * time.Second
+	}
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Hour
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+
+	table, err := tableName(db)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue[T]{db: db, name: name, opts: opts, table: table}, nil
+}
+
+// Enqueue add a job with payload to the queue
+//
+// It return the job ID, or ErrDuplicate if a live job has the same dedupe key
+func (q *Queue[T]) Enqueue(ctx context.Context, payload T, opts EnqueueOptions) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	job := QueueJob{
+		Queue:       q.name,
+		Status:      StatusPending,
+		Priority:    opts.Priority,
+		RunAt:       opts.RunAt,
+		Payload:     data,
+		MaxAttempts: opts.MaxAttempts,
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.MaxAttempts < 1 {
+		job.MaxAttempts = q.opts.MaxAttempts
+	}
+
+	db := q.db.WithContext(ctx)
+	if opts.DedupeKey != "" {
+		job.DedupeKey = &opts.DedupeKey
+		db = db.Clauses(clause.OnConflict{
+			Columns:     []clause.Column{{Name: "queue"}, {Name: "dedupe_key"}},
+			TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: dedupeIndexPredicate}}},
+			DoNothing:   true,
+		})
+	}
+	result := db.Create(&job)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, ErrDuplicate
+	}
+	return job.ID, nil
+}
+
+// Dequeue claim the next due job for the visibility timeout. Jobs whose worker did not finish
+// them before the timeout are claimed again
+//
+// It return nil without error when no job is due
+func (q *Queue[T]) Dequeue(ctx context.Context) (*Job[T], error) {
+	for {
+		var row QueueJob
+		result := q.db.WithContext(ctx).Raw(fmt.Sprintf(`UPDATE %[1]s SET status = ?, attempts = attempts + 1,
+			locked_until = now() + ? * interval '1 millisecond', updated_at = now()
+			WHERE id = (
+				SELECT id FROM %[1]s
+				WHERE queue = ? AND run_at <= now()
+					AND (status = ? OR (status = ? AND locked_until < now()))
+				ORDER BY priority DESC, run_at, id
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED)
+			RETURNING *`, q.table),
+			StatusRunning, q.opts.VisibilityTimeout.Milliseconds(), q.name, StatusPending, StatusRunning).Scan(&row)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, nil
+		}
+
+		// A worker timed out on its last attempt
+		if row.Attempts > row.MaxAttempts {
+			if err := q.bury(ctx, row.ID, row.Attempts, "visibility timeout exceeded"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		job := &Job[T]{
+			ID:          row.ID,
+			Priority:    row.Priority,
+			Attempts:    row.Attempts,
+			MaxAttempts: row.MaxAttempts,
+			LastError:   row.LastError,
+			CreatedAt:   row.CreatedAt,
+		}
+		if err := json.Unmarshal(row.Payload, &job.Payload); err != nil {
+			if err := q.bury(ctx, row.ID, row.Attempts, "invalid payload: "+err.Error()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return job, nil
+	}
+}
+
+// Complete remove a finished job from the queue. It is a no-op if the job was claimed again
+// by another worker after its visibility timeout
+func (q *Queue[T]) Complete(ctx context.Context, job *Job[T]) error {
+	return q.db.WithContext(ctx).
+		Where("id = ? AND status = ? AND attempts = ?", job.ID, StatusRunning, job.Attempts).
+		Delete(&QueueJob{}).Error
+}
+
+// Fail record a failed attempt. The job is retried after an exponential backoff,
+// or dead-lettered when it has no attempts left
+func (q *Queue[T]) Fail(ctx context.Context, job *Job[T], cause error) error {
+	message := ""
+	if cause != nil {
+		message = cause.Error()
+	}
+	if job.Attempts >= job.MaxAttempts {
+		return q.bury(ctx, job.ID, job.Attempts, message)
+	}
+	return q.db.WithContext(ctx).Model(&QueueJob{}).
+		Where("id = ? AND status = ? AND attempts = ?", job.ID, StatusRunning, job.Attempts).
+		Updates(map[string]interface{}{
+			"status":       StatusPending,
+			"run_at":       time.Now().Add(q.backoff(job.Attempts)),
+			"locked_until": nil,
+			"last_error":   message,
+		}).Error
+}
+
+// Extend push the visibility timeout of a running job d from now, for long handlers
+func (q *Queue[T]) Extend(ctx context.Context, job *Job[T], d time.Duration) error {
+	result := q.db.WithContext(ctx).Model(&QueueJob{}).
+		Where("id = ? AND status = ? AND attempts = ?", job.ID, StatusRunning, job.Attempts).
+		Update("locked_until", time.Now().Add(d))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("job is no longer owned by this worker")
+	}
+	return nil
+}
+
+// Requeue move a dead job back to pending with a fresh attempt count
+func (q *Queue[T]) Requeue(ctx context.Context, id int64) error {
+	return q.db.WithContext(ctx).Model(&QueueJob{}).
+		Where("id = ? AND queue = ? AND status = ?", id, q.name, StatusDead).
+		Updates(map[string]interface{}{"status": StatusPending, "attempts": 0, "run_at": time.Now()}).Error
+}
+
+// DeadJobs list dead-lettered jobs of the queue, newest first
+func (q *Queue[T]) DeadJobs(ctx context.Context, limit int) ([]Job[T], error) {
+	var rows []QueueJob
+	if err := q.db.WithContext(ctx).Where("queue = ? AND status = ?", q.name, StatusDead).
+		Order("updated_at desc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	jobs := make([]Job[T], 0, len(rows))
+	for _, row := range rows {
+		job := Job[T]{ID: row.ID, Priority: row.Priority, Attempts: row.Attempts,
+			MaxAttempts: row.MaxAttempts, LastError: row.LastError, CreatedAt: row.CreatedAt}
+		// Dead jobs may hold an invalid payload, keep the zero value then
+		_ = json.Unmarshal(row.Payload, &job.Payload)
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Stats return depth and age of the queue
+func (q *Queue[T]) Stats(ctx context.Context) (stats Stats, err error) {
+	var row struct {
+		Ready, Scheduled, Running, Dead int64
+		OldestReadySeconds              float64
+	}
+	err = q.db.WithContext(ctx).Raw(fmt.Sprintf(`SELECT
+		count(*) FILTER (WHERE status = @pending AND run_at <= now()) AS ready,
+		count(*) FILTER (WHERE status = @pending AND run_at > now()) AS scheduled,
+		count(*) FILTER (WHERE status = @running) AS running,
+		count(*) FILTER (WHERE status = @dead) AS dead,
+		COALESCE(EXTRACT(EPOCH FROM now() - min(run_at) FILTER (WHERE status = @pending AND run_at <= now())), 0) AS oldest_ready_seconds
+		FROM %s WHERE queue = @queue`, q.table),
+		map[string]interface{}{"pending": StatusPending, "running": StatusRunning, "dead": StatusDead, "queue": q.name}).
+		Scan(&row).Error
+	if err != nil {
+		return stats, err
+	}
+	return Stats{
+		Ready:          row.Ready,
+		Scheduled:      row.Scheduled,
+		Running:        row.Running,
+		Dead:           row.Dead,
+		OldestReadyAge: time.Duration(row.OldestReadySeconds * float64(time.Second)),
+	}, nil
+}
+
+// Work run handler on due jobs with concurrency workers until ctx is canceled. A job is completed
+// when handler return nil, and failed (retried or dead-lettered) when it return an error or panics.
+// Database errors do not stop the workers, they are passed to Options.OnError
+//
+// It return nil once ctx is canceled and every worker has stopped
+func (q *Queue[T]) Work(ctx context.Context, concurrency int, handler func(ctx context.Context, job *Job[T]) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.workLoop(ctx, handler)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// workLoop claim and run jobs until ctx is canceled, backing off after errors
+func (q *Queue[T]) workLoop(ctx context.Context, handler func(ctx context.Context, job *Job[T]) error) {
+	failures := 0
+	for ctx.Err() == nil {
+		job, err := q.Dequeue(ctx)
+		if err == nil && job != nil {
+			err = q.run(ctx, job, handler)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := q.opts.PollInterval
+		switch {
+		case err != nil:
+			failures++
+			if q.opts.OnError != nil {
+				q.opts.OnError(err)
+			}
+			delay = q.errorBackoff(failures)
+		case job != nil:
+			// Keep draining while there are jobs
+			failures = 0
+			continue
+		default:
+			failures = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// run call handler and record its outcome, a panic is recorded as a failure
+func (q *Queue[T]) run(ctx context.Context, job *Job[T], handler func(ctx context.Context, job *Job[T]) error) (err error) {
+	var handlerErr error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				handlerErr = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		handlerErr = handler(ctx, job)
+	}()
+
+	// Record the outcome even when ctx was canceled during the handler (shutdown), otherwise the job
+	// stays running until its visibility timeout and the attempt is lost
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+	defer cancel()
+	if handlerErr != nil {
+		return q.Fail(recordCtx, job, handlerErr)
+	}
+	return q.Complete(recordCtx, job)
+}
+
+// bury dead-letter a job
+func (q *Queue[T]) bury(ctx context.Context, id int64, attempts int, message string) error {
+	return q.db.WithContext(ctx).Model(&QueueJob{}).
+		Where("id = ? AND attempts = ?", id, attempts).
+		Updates(map[string]interface{}{"status": StatusDead, "locked_until": nil, "last_error": message}).Error
+}
+
+// backoff return the retry delay after attempts, doubled each attempt with up to 20% jitter
+func (q *Queue[T]) backoff(attempts int) time.Duration {
+	delay := q.opts.BaseBackoff
+	for i := 1; i < attempts && delay < q.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, q.opts.MaxBackoff)
+	return delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+}
+
+// errorBackoff return the delay of Work after consecutive failures, PollInterval doubled
+// on each failure up to maxErrorBackoff
+func (q *Queue[T]) errorBackoff(failures int) time.Duration {
+	delay := q.opts.PollInterval
+	for i := 1; i < failures && delay < maxErrorBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxErrorBackoff)
+}
+
+// tableName return the quoted name of the queue table with the naming strategy of db
+func tableName(db *gorm.DB) (string, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&QueueJob{}); err != nil {
+		return "", err
+	}
+	return stmt.Quote(stmt.Schema.Table), nil
+}
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type testPayload struct {
+	Name string
+}
+
+// newUnreachableQueue return a queue on a database which refuses connections
+func newUnreachableQueue(t *testing.T, opts Options) *Queue[testPayload] {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1 user=test dbname=test connect_timeout=1"}), &gorm.Config{
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := New[testPayload](db, "test", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestBackoff(t *testing.T) {
+	q := &Queue[testPayload]{opts: Options{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	tests := []struct {
+		attempts int
+		base     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			delay := q.backoff(tt.attempts)
+			if delay < tt.base || delay > tt.base+tt.base/5 {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", tt.attempts, delay, tt.base, tt.base+tt.base/5)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("backoff(%d) has no jitter", tt.attempts)
+		}
+	}
+}
+
+func TestErrorBackoff(t *testing.T) {
+	q := &Queue[testPayload]{opts: Options{PollInterval: time.Second}}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, w := range want {
+		if got := q.errorBackoff(i + 1); got != w {
+			t.Errorf("errorBackoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestWorkReportErrorsAndKeepPolling(t *testing.T) {
+	var mu sync.Mutex
+	var reported []time.Time
+	q := newUnreachableQueue(t, Options{
+		PollInterval: 20 * time.Millisecond,
+		OnError: func(err error) {
+			if err == nil {
+				t.Error("OnError called with nil")
+			}
+			mu.Lock()
+			reported = append(reported, time.Now())
+			mu.Unlock()
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := q.Work(ctx, 1, func(ctx context.Context, job *Job[testPayload]) error {
+		t.Error("handler called without a job")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Work = %v, want nil after cancel", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Delays of 20, 40, 80, 160ms fit in 500ms, polling every 20ms would report about 25 errors
+	if len(reported) < 3 || len(reported) > 8 {
+		t.Fatalf("OnError called %d times, want the worker to keep polling with backoff", len(reported))
+	}
+	for i := 2; i < len(reported); i++ {
+		if reported[i].Sub(reported[i-1]) < reported[i-1].Sub(reported[i-2]) {
+			t.Errorf("delay before error %d is shorter than the previous one", i)
+		}
+	}
+}
+
+func TestWorkWithoutOnError(t *testing.T) {
+	q := newUnreachableQueue(t, Options{PollInterval: 10 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := q.Work(ctx, 2, func(ctx context.Context, job *Job[testPayload]) error { return nil }); err != nil {
+		t.Errorf("Work = %v, want nil after cancel", err)
+	}
+}
@@ -1,15 +1,17 @@
 package reposity
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
 
-	dtoMapper "github.com/dranikpg/dto-mapper"
-	"github.com/go-playground/validator/v10"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/schema"
 )
 
@@ -19,10 +21,16 @@ var Connected bool = false
 
 var defaultDB *gorm.DB
 
+// defaultDSN is kept for helpers that need their own connection, like Subscribe
+var defaultDSN string
+
 type SQLQuery[M any, E any] struct {
-	expressStr string
-	args       []interface{}
-	db         *gorm.DB
+	expressStr      string
+	args            []interface{}
+	db              *gorm.DB
+	allowUnfiltered bool
+	returningIDs    bool
+	lock            Lock
 }
 
 func Connect(sqlHost, sqlPort, sqlDbName, sqlSslmode, sqlUser, sqlPassword, currentSchema string) error {
@@ -43,6 +51,11 @@ func Connect(sqlHost, sqlPort, sqlDbName, sqlSslmode, sqlUser, sqlPassword, curr
 		panic("Failed to connect to database!")
 	}
 
+	// Map Postgres errors of every statement to the errors of this package
+	if err := registerErrorCallbacks(database); err != nil {
+		return err
+	}
+
 	// Add uuid-ossp extension for postgres database
 	database.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\";")
 	/*
@@ -55,6 +68,7 @@ func Connect(sqlHost, sqlPort, sqlDbName, sqlSslmode, sqlUser, sqlPassword, curr
 		}
 	*/
 	defaultDB = database
+	defaultDSN = sqlDsn
 	Connected = true
 
 	/*
@@ -77,9 +91,19 @@ func Connect(sqlHost, sqlPort, sqlDbName, sqlSslmode, sqlUser, sqlPassword, curr
 	return nil
 }
 
+// DB return the default database connection, nil before Connect
+func DB() *gorm.DB {
+	return defaultDB
+}
+
+// DSN return the connection string given to Connect, for packages that open their own connection
+func DSN() string {
+	return defaultDSN
+}
+
 func Migrate(models ...interface{}) error {
 	if !Connected {
-		return errors.New("database not connected")
+		return ErrNotConnected
 	}
 
 	err := defaultDB.AutoMigrate(models...)
@@ -130,6 +154,23 @@ func Stats() (stats sql.DBStats, err error) {
 	return sqlDB.Stats(), nil
 }
 
+// orderClause convert a sort param ("-field", "+field") into an ORDER BY expression,
+// default to newest created items first
+func orderClause(sort string) string {
+	if strings.HasPrefix(sort, "-") {
+		return quoteColumn(strings.TrimPrefix(sort, "-")) + " desc"
+	} else if strings.HasPrefix(sort, "+") {
+		return quoteColumn(strings.TrimPrefix(sort, "+")) + " asc"
+	}
+	return "\"created_at\"" + " desc"
+}
+
+// quoteColumn quote a column name of a sort param, quotes inside the name are escaped
+// so it can not end the identifier
+func quoteColumn(name string) string {
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
 // NewQuery create new query instance
 func NewQuery[M any, E any]( /*db *gorm.DB*/ dbInstances ...interface{}) *SQLQuery[M, E] {
 	query := &SQLQuery[M, E]{}
@@ -279,32 +320,27 @@ func (query *SQLQuery[M, E]) AddConditionOfJsonbField(cascadingLogic string, fie
 // Exec run the the query to get all items with current filter, no paging
 func (query *SQLQuery[M, E]) ExecNoPaging(sort string) (dtos []M, count int64, err error) {
 	if !Connected {
-		return dtos, 0, errors.New("database not connected")
+		return dtos, 0, ErrNotConnected
 	}
 	count = 0
 
-	if strings.HasPrefix(sort, "-") {
-		sort = "\"" + strings.TrimPrefix(sort, "-") + "\"" + " desc"
-	} else if strings.HasPrefix(sort, "+") {
-		sort = "\"" + strings.TrimPrefix(sort, "+") + "\"" + " asc"
-	} else {
-		sort = "\"created_at\"" + " desc"
-	}
+	sort = orderClause(sort)
 
 	// Query with filter
 	var items []E
-	result := defaultDB.Order(sort).Where(query.expressStr, query.args...).Find(&items)
-	if result.Error != nil {
-		return dtos, count, result.Error
+	err = withRetry(query.db, "ExecNoPaging", true, func() error {
+		return query.findDB().Order(sort).Where(query.expressStr, query.args...).Find(&items).Error
+	})
+	if err != nil {
+		return dtos, count, dbError(err)
 	}
-	//count = result.RowsAffected
 
 	// Map entity item to DTO model
 	dtos = make([]M, 0)
 	for _, item := range items {
 		// Mapping from entity model to DTO model
 		var dto M
-		if err := dtoMapper.Map(&dto, item); err != nil {
+		if err := MapToDTO(&dto, item); err != nil {
 			return dtos, count, err
 		}
 		dtos = append(dtos, dto)
@@ -312,13 +348,13 @@ func (query *SQLQuery[M, E]) ExecNoPaging(sort string) (dtos []M, count int64, e
 	}
 
 	// Return
-	return dtos, count, result.Error
+	return dtos, count, nil
 }
 
 // ExecPaging run the the query to get items with current filter, with paging
 func (query *SQLQuery[M, E]) ExecWithPaging(sort string, limit int, page int) (dtos []M, count int64, err error) {
 	if !Connected {
-		return dtos, 0, errors.New("database not connected")
+		return dtos, 0, ErrNotConnected
 	}
 
 	// Validate query param
@@ -328,41 +364,36 @@ func (query *SQLQuery[M, E]) ExecWithPaging(sort string, limit int, page int) (d
 	if page < 1 {
 		page = 1
 	}
-	if strings.HasPrefix(sort, "-") {
-		sort = "\"" + strings.TrimPrefix(sort, "-") + "\"" + " desc"
-	} else if strings.HasPrefix(sort, "+") {
-		sort = "\"" + strings.TrimPrefix(sort, "+") + "\"" + " asc"
-	} else {
-		sort = "\"created_at\"" + " desc"
-	}
+	sort = orderClause(sort)
 
 	// Calculate offset
 	offset := limit * (page - 1)
-	var result *gorm.DB
 
-	// Count total number
+	// Count total number, then query with filter
 	var entityModel E
-	result = query.db.Model(entityModel).Where(query.expressStr, query.args...).Count(&count)
-	if result.Error != nil {
-		return dtos, 0, result.Error
-	}
-
-	// Query with filter
 	var items []E
-	result = query.db.Limit(limit).Offset(offset).Order(sort).Where(query.expressStr, query.args...).Find(&items)
+	err = withRetry(query.db, "ExecWithPaging", true, func() error {
+		if err := query.db.Model(entityModel).Where(query.expressStr, query.args...).Count(&count).Error; err != nil {
+			return err
+		}
+		return query.findDB().Limit(limit).Offset(offset).Order(sort).Where(query.expressStr, query.args...).Find(&items).Error
+	})
+	if err != nil {
+		return dtos, count, dbError(err)
+	}
 
 	// Map entity item to DTO model
 	dtos = make([]M, 0)
 	for _, item := range items {
 		// Mapping from entity model to DTO model
 		var dto M
-		if err := dtoMapper.Map(&dto, item); err != nil {
+		if err := MapToDTO(&dto, item); err != nil {
 			return dtos, count, err
 		}
 		dtos = append(dtos, dto)
 	}
 
-	return dtos, count, result.Error
+	return dtos, count, nil
 }
 
 // CreateItemFromDTO map dto (data transfer object) to new database's item struct
@@ -370,31 +401,66 @@ func (query *SQLQuery[M, E]) ExecWithPaging(sort string, limit int, page int) (d
 //
 // It return created item and error
 func CreateItemFromDTO[M any, E any](dto M) (M, error) {
+	return CreateItemFromDTOContext[M, E](context.Background(), dto)
+}
+
+// CreateItemFromDTOContext is CreateItemFromDTO with a context, given to hooks and validation
+func CreateItemFromDTOContext[M any, E any](ctx context.Context, dto M) (M, error) {
 	if !Connected {
-		return dto, errors.New("database not connected")
+		return dto, ErrNotConnected
 	}
+	db := defaultDB.WithContext(ctx)
 
-	// Validate dto object  input
-	validate := validator.New()
-	err := validate.Struct(dto)
+	// Creates are retried only when marked idempotent
+	var created M
+	err := withRetry(db, "CreateItemFromDTO", false, func() (err error) {
+		created, err = createItemFromDTO[M, E](db, dto)
+		return err
+	})
 	if err != nil {
 		return dto, err
 	}
+	return created, nil
+}
+
+// createItemFromDTO validate, map and write dto as a new item with db,
+// in a transaction with the hooks and audit of M and E if any
+func createItemFromDTO[M any, E any](db *gorm.DB, dto M) (M, error) {
+	registered := hooksFor[M, E]()
+	if (len(registered) > 0 || isAudited[E]()) && !inTransaction(db) {
+		var created M
+		err := db.Transaction(func(tx *gorm.DB) (err error) {
+			created, err = createItemFromDTO[M, E](tx, dto)
+			return err
+		})
+		if err != nil {
+			return dto, dbError(err)
+		}
+		return created, nil
+	}
+
+	// Validate dto object  input
+	if err := validateItem[E](db, dto, nil); err != nil {
+		return dto, err
+	}
 
 	// Mapping from DTO to entity model
 	var item E
-	if err := dtoMapper.Map(&item, dto); err != nil {
+	if err := MapToEntity(&item, dto); err != nil {
+		return dto, err
+	}
+	if err := beforeCreate(db, registered, &dto, &item); err != nil {
 		return dto, err
 	}
 
 	// Create new entity using smart select
 	var entity E
-	if result := defaultDB.Model(entity).Create(&item); result.Error != nil {
+	if result := db.Model(entity).Create(&item); result.Error != nil {
 		return dto, result.Error
 	}
 
-	// Mapping from entity model to DTO model
-	if err := dtoMapper.Map(&dto, item); err != nil {
+	// Audit, then mapping from entity model to DTO model
+	if err := afterCreate(db, registered, &dto, &item); err != nil {
 		return dto, err
 	}
 	return dto, nil
@@ -404,17 +470,33 @@ func CreateItemFromDTO[M any, E any](dto M) (M, error) {
 // accepts generic types
 //
 // It return read dto and error
-func ReadItemByIDIntoDTO[M any, E any](id string) (dto M, err error) {
+func ReadItemByIDIntoDTO[M any, E any, K comparable](id K) (dto M, err error) {
+	return ReadItemByIDIntoDTOContext[M, E](context.Background(), id)
+}
+
+// ReadItemByIDIntoDTOContext is ReadItemByIDIntoDTO with a context, given to hooks
+func ReadItemByIDIntoDTOContext[M any, E any, K comparable](ctx context.Context, id K) (dto M, err error) {
 	if !Connected {
-		return dto, errors.New("database not connected")
+		return dto, ErrNotConnected
+	}
+	db := defaultDB.WithContext(ctx)
+	cond, err := primaryKeyCondition[E](db, id)
+	if err != nil {
+		return dto, err
 	}
 	var item E
-	if err := defaultDB.Where("id = ?", id).First(&item).Error; err != nil {
+	err = withRetry(db, "ReadItemByIDIntoDTO", true, func() error {
+		return db.Where(cond).First(&item).Error
+	})
+	if err != nil {
 		return dto, err
 	}
 
 	// Mapping from entity model to DTO model
-	if err := dtoMapper.Map(&dto, item); err != nil {
+	if err := MapToDTO(&dto, item); err != nil {
+		return dto, err
+	}
+	if err := afterRead(ctx, db, hooksFor[M, E](), &dto, &item); err != nil {
 		return dto, err
 	}
 	return dto, nil
@@ -424,32 +506,42 @@ func ReadItemByIDIntoDTO[M any, E any](id string) (dto M, err error) {
 // accepts generic types
 //
 // It return read dtos and error
-func ReadMultiItemsByIDIntoDTO[M any, E any](ids []string, sort string) (dtos []M, count int64, err error) {
+func ReadMultiItemsByIDIntoDTO[M any, E any, K comparable](ids []K, sort string) (dtos []M, count int64, err error) {
+	return ReadMultiItemsByIDIntoDTOContext[M, E](context.Background(), ids, sort)
+}
+
+// ReadMultiItemsByIDIntoDTOContext is ReadMultiItemsByIDIntoDTO with a context, given to hooks
+func ReadMultiItemsByIDIntoDTOContext[M any, E any, K comparable](ctx context.Context, ids []K, sort string) (dtos []M, count int64, err error) {
 	if !Connected {
-		return dtos, 0, errors.New("database not connected")
+		return dtos, 0, ErrNotConnected
 	}
+	db := defaultDB.WithContext(ctx)
 	count = 0
 
-	if strings.HasPrefix(sort, "-") {
-		sort = "\"" + strings.TrimPrefix(sort, "-") + "\"" + " desc"
-	} else if strings.HasPrefix(sort, "+") {
-		sort = "\"" + strings.TrimPrefix(sort, "+") + "\"" + " asc"
-	} else {
-		sort = "\"created_at\"" + " desc"
+	sort = orderClause(sort)
+
+	cond, err := primaryKeysCondition[E](db, ids)
+	if err != nil {
+		return dtos, 0, err
 	}
 
 	var items []E
-	result := defaultDB.Order(sort).Where("id IN ?", ids).Find(&items)
-	if result.Error != nil {
-		return dtos, 0, result.Error
+	err = withRetry(db, "ReadMultiItemsByIDIntoDTO", true, func() error {
+		return db.Order(sort).Where(cond).Find(&items).Error
+	})
+	if err != nil {
+		return dtos, 0, err
 	}
-	//count = result.RowsAffected
 
+	registered := hooksFor[M, E]()
 	dtos = make([]M, 0)
 	for _, item := range items {
 		// Mapping from entity model to DTO model
 		var dto M
-		if err := dtoMapper.Map(&dto, item); err != nil {
+		if err := MapToDTO(&dto, item); err != nil {
+			return dtos, count, err
+		}
+		if err := afterRead(ctx, db, registered, &dto, &item); err != nil {
 			return dtos, count, err
 		}
 		dtos = append(dtos, dto)
@@ -464,32 +556,36 @@ func ReadMultiItemsByIDIntoDTO[M any, E any](ids []string, sort string) (dtos []
 //
 // It return read dtos and error
 func ReadAllItemsIntoDTO[M any, E any](sort string) (dtos []M, count int64, err error) {
+	return ReadAllItemsIntoDTOContext[M, E](context.Background(), sort)
+}
+
+// ReadAllItemsIntoDTOContext is ReadAllItemsIntoDTO with a context, given to hooks
+func ReadAllItemsIntoDTOContext[M any, E any](ctx context.Context, sort string) (dtos []M, count int64, err error) {
 	if !Connected {
-		return dtos, 0, errors.New("database not connected")
+		return dtos, 0, ErrNotConnected
 	}
+	db := defaultDB.WithContext(ctx)
 	count = 0
 
-	if strings.HasPrefix(sort, "-") {
-		sort = "\"" + strings.TrimPrefix(sort, "-") + "\"" + " desc"
-	} else if strings.HasPrefix(sort, "+") {
-		sort = "\"" + strings.TrimPrefix(sort, "+") + "\"" + " asc"
-	} else {
-		sort = "\"created_at\"" + " desc"
-	}
+	sort = orderClause(sort)
 
 	var items []E
-
-	result := defaultDB.Order(sort).Find(&items)
-	if result.Error != nil {
-		return dtos, 0, result.Error
+	err = withRetry(db, "ReadAllItemsIntoDTO", true, func() error {
+		return db.Order(sort).Find(&items).Error
+	})
+	if err != nil {
+		return dtos, 0, err
 	}
-	//count = result.RowsAffected
 
 	// Mapping from entity model to DTO model
+	registered := hooksFor[M, E]()
 	dtos = make([]M, 0)
 	for _, item := range items {
 		var dto M
-		if err := dtoMapper.Map(&dto, item); err != nil {
+		if err := MapToDTO(&dto, item); err != nil {
+			return dtos, count, err
+		}
+		if err := afterRead(ctx, db, registered, &dto, &item); err != nil {
 			return dtos, count, err
 		}
 		dtos = append(dtos, dto)
@@ -504,18 +600,29 @@ func ReadAllItemsIntoDTO[M any, E any](sort string) (dtos []M, count int64, err
 //
 // It return read dto and error
 func ReadItemWithFilterIntoDTO[M any, E any](query string, args ...interface{}) (dto M, err error) {
+	return ReadItemWithFilterIntoDTOContext[M, E](context.Background(), query, args...)
+}
+
+// ReadItemWithFilterIntoDTOContext is ReadItemWithFilterIntoDTO with a context, given to hooks
+func ReadItemWithFilterIntoDTOContext[M any, E any](ctx context.Context, query string, args ...interface{}) (dto M, err error) {
 	if !Connected {
-		return dto, errors.New("database not connected")
+		return dto, ErrNotConnected
 	}
+	db := defaultDB.WithContext(ctx)
 
 	var item E
-	result := defaultDB.Where(query, args...).First(&item)
-	if result.Error != nil {
-		return dto, result.Error
+	err = withRetry(db, "ReadItemWithFilterIntoDTO", true, func() error {
+		return db.Where(query, args...).First(&item).Error
+	})
+	if err != nil {
+		return dto, err
 	}
 
 	// Mapping from entity model to DTO model
-	if err := dtoMapper.Map(&dto, item); err != nil {
+	if err := MapToDTO(&dto, item); err != nil {
+		return dto, err
+	}
+	if err := afterRead(ctx, db, hooksFor[M, E](), &dto, &item); err != nil {
 		return dto, err
 	}
 
@@ -526,29 +633,77 @@ func ReadItemWithFilterIntoDTO[M any, E any](query string, args ...interface{})
 // accepts generic types. Empty (null) field will not be updated
 //
 // It return updated item (dto) and error
-func UpdateItemByIDFromDTO[M any, E any](id string, dto M) (M, error) {
+func UpdateItemByIDFromDTO[M any, E any, K comparable](id K, dto M) (M, error) {
+	return UpdateItemByIDFromDTOContext[M, E](context.Background(), id, dto)
+}
+
+// UpdateItemByIDFromDTOContext is UpdateItemByIDFromDTO with a context, given to hooks and validation
+func UpdateItemByIDFromDTOContext[M any, E any, K comparable](ctx context.Context, id K, dto M) (M, error) {
 	if !Connected {
-		return dto, errors.New("database not connected")
+		return dto, ErrNotConnected
+	}
+	db := defaultDB.WithContext(ctx)
+
+	// Updates are retried only when marked idempotent, like creates
+	var updated M
+	err := withRetry(db, "UpdateItemByIDFromDTO", false, func() (err error) {
+		updated, err = updateItemByIDFromDTO[M, E](db, id, dto)
+		return err
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// updateItemByIDFromDTO patch the item by ID with the non-empty fields of dto using db,
+// in a transaction with the hooks and audit of M and E if any
+func updateItemByIDFromDTO[M any, E any, K comparable](db *gorm.DB, id K, dto M) (M, error) {
+	registered := hooksFor[M, E]()
+	if (len(registered) > 0 || isAudited[E]()) && !inTransaction(db) {
+		var updated M
+		err := db.Transaction(func(tx *gorm.DB) (err error) {
+			updated, err = updateItemByIDFromDTO[M, E](tx, id, dto)
+			return err
+		})
+		if err != nil {
+			return dto, dbError(err)
+		}
+		return updated, nil
+	}
+
+	cond, err := primaryKeyCondition[E](db, id)
+	if err != nil {
+		return dto, err
+	}
+
+	// Validate non-empty fields of dto object input, the only ones updated
+	if err := validateItemFields[E](db, dto, cond, nonZeroPaths(dto)); err != nil {
+		return dto, err
 	}
 
 	// Check item exist by ID
 	var item E
-	if err := defaultDB.Where("id = ?", id).First(&item).Error; err != nil {
+	if err := db.Where(cond).First(&item).Error; err != nil {
 		return dto, err
 	}
 
-	// Mapping from DTO to entity model
-	if err := dtoMapper.Map(&item, dto); err != nil {
+	// Mapping from DTO to entity model, only the non-empty fields written by Updates are assigned
+	// so item hold the stored values after the update. old keep the stored values for hooks and audit
+	old := item
+	var mapped E
+	if err := MapToEntity(&mapped, dto); err != nil {
 		return dto, err
 	}
-
-	// Update item
-	if err := defaultDB.Model(item).Where("id = ?", id).Updates(&item).Error; err != nil {
+	if err := assignNonZeroFields(db, &item, &mapped); err != nil {
 		return dto, err
 	}
 
-	// Mapping back from updated entity to DTO
-	if err := dtoMapper.Map(&dto, item); err != nil {
+	// Update item between the update hooks, then map it back to DTO
+	err = updateWithHooks(db, registered, &old, &dto, &item, &dto, func() error {
+		return db.Model(item).Where(cond).Updates(&item).Error
+	})
+	if err != nil {
 		return dto, err
 	}
 
@@ -556,21 +711,98 @@ func UpdateItemByIDFromDTO[M any, E any](id string, dto M) (M, error) {
 	return dto, nil
 }
 
+// assignNonZeroFields copy into dst the fields of src that Updates write when given a struct:
+// updatable columns with a non-zero value, except the primary key
+func assignNonZeroFields[E any](db *gorm.DB, dst *E, src *E) error {
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return err
+	}
+	ctx := statementContext(db)
+	dstValue, srcValue := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for _, field := range entitySchema.Fields {
+		if field.DBName == "" || field.PrimaryKey || !field.Updatable {
+			continue
+		}
+		value, zero := field.ValueOf(ctx, srcValue)
+		if zero {
+			continue
+		}
+		if err := field.Set(ctx, dstValue, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // DeleteItemByID delete item by ID,
 // accepts generic types.
 //
 // It return error if there is any
-func DeleteItemByID[E any](id string) (err error) {
+func DeleteItemByID[E any, K comparable](id K) (err error) {
+	return DeleteItemByIDContext[E](context.Background(), id)
+}
+
+// DeleteItemByIDContext is DeleteItemByID with a context, given to hooks. With delete hooks or audit,
+// the item is loaded first and ErrNotFound is returned if it does not exist
+func DeleteItemByIDContext[E any, K comparable](ctx context.Context, id K) (err error) {
 	if !Connected {
-		return errors.New("database not connected")
+		return ErrNotConnected
 	}
 
-	var item E
-	if err = defaultDB.Where("id = ?", id).Delete(&item).Error; err != nil {
+	// Walk the relations declared with RegisterCascade
+	if hasCascades[E]() {
+		_, err = DeleteItemByIDCascadeContext[E](ctx, id, true)
 		return err
 	}
 
-	return nil
+	db := defaultDB.WithContext(ctx)
+	cond, err := primaryKeyCondition[E](db, id)
+	if err != nil {
+		return err
+	}
+
+	registered := deleteHooksFor[E]()
+	if len(registered) == 0 && !isAudited[E]() {
+		var item E
+		return withRetry(db, "DeleteItemByID", false, func() error {
+			return db.Where(cond).Delete(&item).Error
+		})
+	}
+	return transaction(ctx, "DeleteItemByID", false, func(tx *gorm.DB) error {
+		var item E
+		return deleteItemWithHooks(tx, cond, &item, registered, true, CascadeReport{})
+	})
+}
+
+// deleteItemWithHooks load the item matching cond, run the delete hooks around its deletion,
+// walking the relations declared with RegisterCascade, and audit it. Soft deleted items are
+// only found and removed from database when soft is false
+func deleteItemWithHooks[E any](tx *gorm.DB, cond clause.Expression, item *E, registered []hooksEntry, soft bool, report CascadeReport) error {
+	entitySchema, err := parseEntitySchema[E](tx)
+	if err != nil {
+		return err
+	}
+	db := tx
+	if !soft {
+		db = tx.Unscoped()
+	}
+	if err := db.Where(cond).First(item).Error; err != nil {
+		return err
+	}
+
+	return deleteWithHooks(tx, registered, item, func() error {
+		if hasCascades[E]() {
+			now := time.Now().Truncate(time.Microsecond) // precision of Postgres timestamps
+			return cascadeDelete(tx, entitySchema, []clause.Expression{cond}, soft, now, report, 0)
+		}
+		result := db.Where(cond).Delete(item)
+		if result.Error != nil {
+			return result.Error
+		}
+		report[entitySchema.Table] += result.RowsAffected
+		return nil
+	})
 }
 
 // DeleteAllItem delete all item,
@@ -579,65 +811,121 @@ func DeleteItemByID[E any](id string) (err error) {
 // It return error if there is any
 func DeleteAllItem[E any](softDelete bool) (err error) {
 	if !Connected {
-		return errors.New("database not connected")
+		return ErrNotConnected
 	}
 
+	// Items are deleted one by one between their delete hooks, and audited
+	if registered := deleteHooksFor[E](); len(registered) > 0 || isAudited[E]() {
+		return transaction(context.Background(), "DeleteAllItem", false, func(tx *gorm.DB) error {
+			if !softDelete {
+				tx = tx.Unscoped()
+			}
+			var items []E
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&items).Error; err != nil {
+				return err
+			}
+			_, err := deleteItemsWithHooks(tx, items, softDelete, registered)
+			return err
+		})
+	}
+
+	// AllowGlobalUpdate lets GORM delete without conditions
 	var item E
+	db := defaultDB.Session(&gorm.Session{AllowGlobalUpdate: true})
 	if softDelete {
 		// Softdelete: the record WON'T be removed from the database,
 		// but GORM will set the DeletedAt's value to the current time,
 		// and the data is not findable with normal Query methods anymore.
-		// You can find soft deleted records with Unscoped:
-		// db.Unscoped().Where("age = 20").Find(&user)
-		if err = defaultDB.Where("created_at > ?", "2000-01-01 00:00:00").Delete(&item).Error; err != nil {
-			return err
-		}
-	} else {
-		if err = defaultDB.Unscoped().Where("created_at > ?", "2000-01-01 00:00:00").Delete(&item).Error; err != nil {
-			return err
-		}
-	}
-
-	return nil
+		// You can find soft deleted records with ReadTrashed or OnlyTrashed
+		return withRetry(db, "DeleteAllItem", false, func() error {
+			return db.Delete(&item).Error
+		})
+	}
+	return withRetry(db, "DeleteAllItem", false, func() error {
+		return db.Unscoped().Delete(&item).Error
+	})
 }
 
 // CheckItemExistedByID check item is existed by ID,
 // accepts generic types.
 //
 // It return true if item is existed
-func CheckItemExistedByID[E any](id string) (exists bool, err error) {
+func CheckItemExistedByID[E any, K comparable](id K) (exists bool, err error) {
 	if !Connected {
-		return exists, errors.New("database not connected")
+		return exists, ErrNotConnected
 	}
-
-	var item E
-	if err = defaultDB.Model(item).Select("count(*) > 0").Where("id = ?", id).Find(&exists).Error; err != nil {
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
 		return exists, err
 	}
 
-	return exists, nil
+	var item E
+	err = withRetry(defaultDB, "CheckItemExistedByID", true, func() error {
+		return defaultDB.Model(item).Select("count(*) > 0").Where(cond).Find(&exists).Error
+	})
+	return exists, err
 }
 
 // UpdateSingleColumn check if item ID exist in database, then updating it (actually patching),
-// accepts generic types. Empty (null) field will not be updated
+// accepts generic types. Empty (null) field will not be updated. With update hooks or audit, value
+// must be assignable to the field of the column
 //
 // It return error
-func UpdateSingleColumn[E any](id string, columnName string, value interface{}) error {
+func UpdateSingleColumn[E any, K comparable](id K, columnName string, value interface{}) error {
 	if !Connected {
-		return errors.New("database not connected")
+		return ErrNotConnected
 	}
-	// Check item exist by ID
-	var item E
-	if err := defaultDB.Where("id = ?", id).First(&item).Error; err != nil {
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
 		return err
 	}
 
-	// Update item
-	if err := defaultDB.Model(item).Where("id = ?", id).Update(columnName, value).Error; err != nil {
+	registered := updateHooksFor[E]()
+	if len(registered) > 0 || isAudited[E]() {
+		return transaction(context.Background(), "UpdateSingleColumn", false, func(tx *gorm.DB) error {
+			return updateColumnWithHooks[E](tx, cond, columnName, value, registered)
+		})
+	}
+
+	return withRetry(defaultDB, "UpdateSingleColumn", false, func() error {
+		// Check item exist by ID
+		var item E
+		if err := defaultDB.Where(cond).First(&item).Error; err != nil {
+			return err
+		}
+
+		// Update item
+		return defaultDB.Model(item).Where(cond).Update(columnName, value).Error
+	})
+}
+
+// updateColumnWithHooks lock the item matching cond, set the field of column to value
+// and update it between the update hooks
+func updateColumnWithHooks[E any](tx *gorm.DB, cond clause.Expression, column string, value interface{}, registered []hooksEntry) error {
+	entitySchema, err := parseEntitySchema[E](tx)
+	if err != nil {
 		return err
 	}
+	field := entitySchema.LookUpField(column)
+	if field == nil || field.DBName == "" {
+		return fmt.Errorf("%s has no column %s", entitySchema.Name, column)
+	}
 
-	return nil
+	var item E
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(cond).First(&item).Error; err != nil {
+		return err
+	}
+	old := item
+	itemValue := reflect.ValueOf(&item).Elem()
+	if err := field.Set(statementContext(tx), itemValue, value); err != nil {
+		return fmt.Errorf("set %s.%s: %w", entitySchema.Name, field.Name, err)
+	}
+
+	return updateEntityWithHooks(tx, registered, &old, &item, func() error {
+		// Changes of the hooks to this field are written
+		newValue, _ := field.ValueOf(statementContext(tx), itemValue)
+		return tx.Model(&item).Where(cond).Update(field.DBName, newValue).Error
+	})
 }
 
 //===============================
@@ -657,7 +945,7 @@ func (query *SQLQuery[M, E]) AddPreload(relation string) *SQLQuery[M, E] {
 // ExecCustomQuery executes a custom SQL query with support for multiple tables
 func (query *SQLQuery[M, E]) ExecCustomQuery(rawQuery string, args ...interface{}) (dtos []M, count int64, err error) {
 	if !Connected {
-		return dtos, 0, errors.New("database not connected")
+		return dtos, 0, ErrNotConnected
 	}
 	count = 0
 
@@ -670,7 +958,7 @@ func (query *SQLQuery[M, E]) ExecCustomQuery(rawQuery string, args ...interface{
 	dtos = make([]M, 0)
 	for _, item := range items {
 		var dto M
-		if err := dtoMapper.Map(&dto, item); err != nil {
+		if err := MapToDTO(&dto, item); err != nil {
 			return dtos, count, err
 		}
 		dtos = append(dtos, dto)
@@ -682,7 +970,7 @@ func (query *SQLQuery[M, E]) ExecCustomQuery(rawQuery string, args ...interface{
 // ExecCustomQueryWithPaging executes a custom SQL query with pagination support
 func (query *SQLQuery[M, E]) ExecCustomQueryWithPaging(rawQuery string, limit, page int, args ...interface{}) (dtos []M, count int64, err error) {
 	if !Connected {
-		return dtos, 0, errors.New("database not connected")
+		return dtos, 0, ErrNotConnected
 	}
 
 	// Validate query parameters
@@ -715,7 +1003,7 @@ func (query *SQLQuery[M, E]) ExecCustomQueryWithPaging(rawQuery string, limit, p
 	dtos = make([]M, 0)
 	for _, item := range items {
 		var dto M
-		if err := dtoMapper.Map(&dto, item); err != nil {
+		if err := MapToDTO(&dto, item); err != nil {
 			return dtos, count, err
 		}
 		dtos = append(dtos, dto)
@@ -0,0 +1,61 @@
+package reposity
+
+import (
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// newTestDB open a database handle which never connects, for the helpers that only
+// parse schemas or build statements
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 user=test dbname=test"}), &gorm.Config{
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestOrderClause(t *testing.T) {
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"", `"created_at" desc`},
+		{"name", `"created_at" desc`},
+		{"-name", `"name" desc`},
+		{"+name", `"name" asc`},
+		{`+name" desc; DROP TABLE users; --`, `"name"" desc; DROP TABLE users; --" asc`},
+	}
+	for _, tt := range tests {
+		if got := orderClause(tt.sort); got != tt.want {
+			t.Errorf("orderClause(%q) = %s, want %s", tt.sort, got, tt.want)
+		}
+	}
+}
+
+type assignItem struct {
+	ID      int64 `gorm:"primaryKey"`
+	Name    string
+	Count   int
+	Note    *string
+	Version int
+}
+
+func TestAssignNonZeroFields(t *testing.T) {
+	db := newTestDB(t)
+	note := "stored"
+	item := assignItem{ID: 1, Name: "Bob", Count: 3, Note: &note, Version: 2}
+	mapped := assignItem{ID: 9, Name: "Robert"}
+	if err := assignNonZeroFields(db, &item, &mapped); err != nil {
+		t.Fatal(err)
+	}
+	want := assignItem{ID: 1, Name: "Robert", Count: 3, Note: &note, Version: 2}
+	if item != want {
+		t.Errorf("assignNonZeroFields = %+v, want %+v", item, want)
+	}
+}
@@ -0,0 +1,169 @@
+package reposity
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RetryPolicy decide how helpers and Transaction are retried when they fail because of another
+// transaction, like serialization failures (SQLSTATE 40001) and deadlocks (SQLSTATE 40P01).
+// The failed attempt is rolled back by Postgres, so only its side effects outside the database
+// make a retry unsafe, like hooks busting a cache: reads are retried, writes and Transaction only
+// when their context is marked with MarkIdempotent. Helpers without a context are never marked
+type RetryPolicy struct {
+	MaxAttempts int                  // attempts including the first one, 1 or less disable retries
+	BaseDelay   time.Duration        // delay before the first retry, doubled at each retry, with jitter
+	MaxDelay    time.Duration        // maximum delay between attempts
+	Retryable   func(err error) bool // errors worth a retry, IsRetryable if nil
+}
+
+// DefaultRetryPolicy is the policy used until SetRetryPolicy is called
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 20 * time.Millisecond, MaxDelay: time.Second}
+
+// RetryEvent describe a retry, given to the functions registered with RegisterRetryObserver
+type RetryEvent struct {
+	Operation string        // helper name, e.g. "UpdateItemByIDFromDTO"
+	Attempt   int           // failed attempt, from 1
+	Delay     time.Duration // wait before the next attempt
+	Err       error         // error of the failed attempt
+}
+
+// RetryMetrics count retries since the program started
+type RetryMetrics struct {
+	Retries   uint64 // failed attempts followed by another attempt
+	Recovered uint64 // operations which succeeded after at least one retry
+	Exhausted uint64 // operations which still failed after MaxAttempts attempts
+}
+
+var (
+	retryPolicy atomic.Pointer[RetryPolicy]
+
+	retryObserversMu sync.RWMutex
+	retryObservers   []func(RetryEvent)
+
+	retries, recovered, exhausted atomic.Uint64
+)
+
+type idempotentKey struct{}
+
+func init() {
+	SetRetryPolicy(DefaultRetryPolicy)
+}
+
+// SetRetryPolicy replace the retry policy of all helpers
+func SetRetryPolicy(policy RetryPolicy) {
+	if policy.Retryable == nil {
+		policy.Retryable = IsRetryable
+	}
+	retryPolicy.Store(&policy)
+}
+
+// RegisterRetryObserver add a function called before each retry, e.g. to count retries per operation
+// in a metrics system. It must be quick, it run before waiting for the next attempt
+func RegisterRetryObserver(fn func(RetryEvent)) {
+	retryObserversMu.Lock()
+	defer retryObserversMu.Unlock()
+	retryObservers = append(retryObservers, fn)
+}
+
+// RetryStats return the retry counters
+func RetryStats() RetryMetrics {
+	return RetryMetrics{Retries: retries.Load(), Recovered: recovered.Load(), Exhausted: exhausted.Load()}
+}
+
+// MarkIdempotent return a copy of ctx marking operations run with it safe to retry: the function given
+// to Transaction and the hooks of the written entities have no side effects outside the database,
+// or they are idempotent
+func MarkIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// isIdempotent report whether ctx was marked with MarkIdempotent
+func isIdempotent(ctx context.Context) bool {
+	marked, _ := ctx.Value(idempotentKey{}).(bool)
+	return marked
+}
+
+// withRetry run fn, the operation of a helper on db, and retry it following the retry policy when it
+// is safe: safe is true for reads without side effects, or the context of db is marked idempotent. Operations on a transaction are not
+// retried, the whole transaction has to be
+func withRetry(db *gorm.DB, operation string, safe bool, fn func() error) error {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	policy := retryPolicy.Load()
+	if policy.MaxAttempts <= 1 || inTransaction(db) || !safe && !isIdempotent(ctx) {
+		return fn()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				recovered.Add(1)
+			}
+			return nil
+		}
+		if !policy.Retryable(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			exhausted.Add(1)
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		retries.Add(1)
+		notifyRetry(RetryEvent{Operation: operation, Attempt: attempt, Delay: delay, Err: err})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// transaction run fn in a transaction on the default database, retried like withRetry
+func transaction(ctx context.Context, operation string, safe bool, fn func(tx *gorm.DB) error) error {
+	db := defaultDB.WithContext(ctx)
+	return withRetry(db, operation, safe, func() error {
+		return dbError(db.Transaction(fn))
+	})
+}
+
+// backoff return the delay after a failed attempt: BaseDelay doubled at each attempt up to MaxDelay,
+// half of it randomized so conflicting transactions do not retry in lockstep
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.BaseDelay << (attempt - 1)
+	if delay <= 0 || policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// notifyRetry call the retry observers
+func notifyRetry(event RetryEvent) {
+	retryObserversMu.RLock()
+	defer retryObserversMu.RUnlock()
+	for _, fn := range retryObservers {
+		fn(event)
+	}
+}
+
+// inTransaction report whether db run its statements in a transaction
+func inTransaction(db *gorm.DB) bool {
+	_, ok := db.Statement.ConnPool.(gorm.TxCommitter)
+	return ok
+}
@@ -0,0 +1,126 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// setTestRetryPolicy replace the retry policy for the duration of a test
+func setTestRetryPolicy(t *testing.T, policy RetryPolicy) {
+	t.Helper()
+	previous := *retryPolicy.Load()
+	SetRetryPolicy(policy)
+	t.Cleanup(func() { retryPolicy.Store(&previous) })
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		delay   time.Duration // delay before jitter
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{64, time.Second}, // the shift overflows
+	}
+	for _, tt := range tests {
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			got := policy.backoff(tt.attempt)
+			if got < tt.delay/2 || got > tt.delay {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", tt.attempt, got, tt.delay/2, tt.delay)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("backoff(%d) has no jitter", tt.attempt)
+		}
+	}
+
+	if got := (&RetryPolicy{}).backoff(1); got != 0 {
+		t.Errorf("backoff of zero policy = %v, want 0", got)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	setTestRetryPolicy(t, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond})
+	conflict := dbError(&pgconn.PgError{Code: "40001"})
+	invalid := errors.New("invalid input")
+
+	db := newTestDB(t)
+	tx := db.WithContext(context.Background())
+	tx.Statement.ConnPool = fakeTx{}
+
+	tests := []struct {
+		name       string
+		idempotent bool
+		safe       bool
+		inTx       bool
+		failures   int
+		err        error
+		wantCalls  int
+		wantErr    bool
+	}{
+		{name: "read recovers", safe: true, failures: 2, err: conflict, wantCalls: 3},
+		{name: "read exhausted", safe: true, failures: 5, err: conflict, wantCalls: 3, wantErr: true},
+		{name: "read not retryable", safe: true, failures: 1, err: invalid, wantCalls: 1, wantErr: true},
+		{name: "write not marked", failures: 1, err: conflict, wantCalls: 1, wantErr: true},
+		{name: "write marked idempotent", idempotent: true, failures: 2, err: conflict, wantCalls: 3},
+		{name: "in transaction", safe: true, inTx: true, failures: 1, err: conflict, wantCalls: 1, wantErr: true},
+		{name: "marked in transaction", idempotent: true, inTx: true, failures: 1, err: conflict, wantCalls: 1, wantErr: true},
+		{name: "no failure", safe: true, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.idempotent {
+				ctx = MarkIdempotent(ctx)
+			}
+			target := db.WithContext(ctx)
+			if tt.inTx {
+				target = tx.WithContext(ctx)
+			}
+
+			calls := 0
+			err := withRetry(target, "test", tt.safe, func() error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("withRetry = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("withRetry = %v, want the error of the last attempt %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopOnCancel(t *testing.T) {
+	setTestRetryPolicy(t, RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour})
+	conflict := dbError(&pgconn.PgError{Code: "40P01"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := withRetry(newTestDB(t).WithContext(ctx), "test", true, func() error {
+		calls++
+		cancel()
+		return conflict
+	})
+	if calls != 1 || !errors.Is(err, ErrDeadlock) {
+		t.Errorf("withRetry = %v after %d calls, want the deadlock after 1 call", err, calls)
+	}
+}
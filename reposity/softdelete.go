@@ -0,0 +1,256 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ErrNoSoftDelete is returned by the trash helpers when the entity has no gorm.DeletedAt field
+var ErrNoSoftDelete = errors.New("entity does not support soft delete")
+
+// WithTrashed make the query include soft deleted items
+func (query *SQLQuery[M, E]) WithTrashed() *SQLQuery[M, E] {
+	query.db = query.db.Unscoped().Session(&gorm.Session{})
+	return query
+}
+
+// OnlyTrashed make the query return only soft deleted items
+func (query *SQLQuery[M, E]) OnlyTrashed() *SQLQuery[M, E] {
+	column := "deleted_at"
+	if field, err := deletedAtField[E](query.db); err == nil {
+		column = field.DBName
+	}
+	query.db = query.db.Unscoped().
+		Where("? IS NOT NULL", clause.Column{Table: clause.CurrentTable, Name: column}).
+		Session(&gorm.Session{})
+	return query
+}
+
+// ReadTrashed read all soft deleted items from database then map result into dto (data transfer object),
+// accepts generic types
+//
+// It return read dtos and error
+func ReadTrashed[M any, E any](sort string) (dtos []M, count int64, err error) {
+	if !Connected {
+		return dtos, 0, ErrNotConnected
+	}
+	if _, err := deletedAtField[E](defaultDB); err != nil {
+		return dtos, 0, err
+	}
+	return NewQuery[M, E]().OnlyTrashed().ExecNoPaging(sort)
+}
+
+// RestoreItemByID restore a soft deleted item by ID, accepts generic types
+//
+// It return ErrNotFound if no soft deleted item has this ID
+func RestoreItemByID[E any, K comparable](id K) error {
+	if !Connected {
+		return ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return err
+	}
+	field, err := deletedAtField[E](defaultDB)
+	if err != nil {
+		return err
+	}
+
+	// Restore the items deleted with it through RegisterCascade relations
+	if hasCascades[E]() {
+		_, err := RestoreItemByIDCascade[E](id)
+		return err
+	}
+	if registered := updateHooksFor[E](); len(registered) > 0 || isAudited[E]() {
+		return transaction(context.Background(), "RestoreItemByID", false, func(tx *gorm.DB) error {
+			return restoreItemWithHooks[E](tx, cond, registered, CascadeReport{})
+		})
+	}
+
+	var item E
+	result := defaultDB.Unscoped().Model(&item).
+		Where(cond).
+		Where("? IS NOT NULL", clause.Column{Table: clause.CurrentTable, Name: field.DBName}).
+		Update(field.DBName, nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return dbError(gorm.ErrRecordNotFound)
+	}
+	return nil
+}
+
+// HardDeleteItemByID remove an item by ID from database, even if it supports soft delete,
+// accepts generic types
+//
+// It return error if there is any
+func HardDeleteItemByID[E any, K comparable](id K) error {
+	if !Connected {
+		return ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return err
+	}
+
+	// Walk the relations declared with RegisterCascade
+	if hasCascades[E]() {
+		_, err := DeleteItemByIDCascade[E](id, false)
+		return err
+	}
+	if registered := deleteHooksFor[E](); len(registered) > 0 || isAudited[E]() {
+		return transaction(context.Background(), "HardDeleteItemByID", false, func(tx *gorm.DB) error {
+			var item E
+			return deleteItemWithHooks(tx, cond, &item, registered, false, CascadeReport{})
+		})
+	}
+
+	var item E
+	return defaultDB.Unscoped().Where(cond).Delete(&item).Error
+}
+
+// PurgeDeletedOlderThan remove from database the items soft deleted more than age ago,
+// accepts generic types. The relations declared with RegisterCascade are walked like
+// HardDeleteItemByID, in one transaction. With delete hooks or audit, items are deleted one by one
+//
+// It return number of removed items and error
+func PurgeDeletedOlderThan[E any](age time.Duration) (int64, error) {
+	if !Connected {
+		return 0, ErrNotConnected
+	}
+	field, err := deletedAtField[E](defaultDB)
+	if err != nil {
+		return 0, err
+	}
+	cond := clause.Lt{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: time.Now().Add(-age)}
+
+	if registered := deleteHooksFor[E](); len(registered) > 0 || isAudited[E]() {
+		return purgeItemsWithHooks[E](cond, registered)
+	}
+
+	// Walk the relations declared with RegisterCascade
+	if hasCascades[E]() {
+		entitySchema, err := parseEntitySchema[E](defaultDB)
+		if err != nil {
+			return 0, err
+		}
+		var report CascadeReport
+		now := time.Now().Truncate(time.Microsecond)
+		err = transaction(context.Background(), "PurgeDeletedOlderThan", false, func(tx *gorm.DB) error {
+			report = CascadeReport{}
+			return cascadeDelete(tx, entitySchema, []clause.Expression{cond}, false, now, report, 0)
+		})
+		if err != nil {
+			return 0, err
+		}
+		return report[entitySchema.Table], nil
+	}
+
+	var item E
+	result := defaultDB.Unscoped().Where(cond).Delete(&item)
+	return result.RowsAffected, result.Error
+}
+
+// purgeItemsWithHooks remove the soft deleted items matching cond one by one, between their delete hooks
+func purgeItemsWithHooks[E any](cond clause.Expression, registered []hooksEntry) (int64, error) {
+	entitySchema, err := parseEntitySchema[E](defaultDB)
+	if err != nil {
+		return 0, err
+	}
+
+	var report CascadeReport
+	err = transaction(context.Background(), "PurgeDeletedOlderThan", false, func(tx *gorm.DB) error {
+		report = CascadeReport{}
+		var items []E
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Where(cond).Find(&items).Error; err != nil {
+			return err
+		}
+		for i := range items {
+			itemCond, err := itemKeyCondition(tx, &items[i])
+			if err != nil {
+				return err
+			}
+			if err := deleteItemWithHooks(tx, itemCond, &items[i], registered, false, report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return report[entitySchema.Table], nil
+}
+
+// restoreItemWithHooks lock the soft deleted item matching cond and restore it between the update hooks,
+// with the items deleted with it through CascadeDelete relations
+func restoreItemWithHooks[E any](tx *gorm.DB, cond clause.Expression, registered []hooksEntry, report CascadeReport) error {
+	entitySchema, err := parseEntitySchema[E](tx)
+	if err != nil {
+		return err
+	}
+	field, err := deletedAtField[E](tx)
+	if err != nil {
+		return err
+	}
+
+	var item E
+	if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where(cond).
+		Where("? IS NOT NULL", clause.Column{Table: clause.CurrentTable, Name: field.DBName}).
+		First(&item).Error; err != nil {
+		return err
+	}
+	old := item
+	ctx := statementContext(tx)
+	itemValue := reflect.ValueOf(&item).Elem()
+	value, _ := field.ValueOf(ctx, itemValue)
+	deletedAt := value.(gorm.DeletedAt).Time
+	if err := field.Set(ctx, itemValue, gorm.DeletedAt{}); err != nil {
+		return err
+	}
+
+	return updateEntityWithHooks(tx, registered, &old, &item, func() error {
+		// Children deleted with the item share its deletion time
+		if hasCascades[E]() {
+			return cascadeRestore(tx, entitySchema, []clause.Expression{cond}, deletedAt, report, 0)
+		}
+		result := tx.Unscoped().Model(&item).Where(cond).Update(field.DBName, nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		report[entitySchema.Table] += result.RowsAffected
+		return nil
+	})
+}
+
+// deletedAtField find the gorm.DeletedAt field of entity E
+func deletedAtField[E any](db *gorm.DB) (*schema.Field, error) {
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return nil, err
+	}
+	if field := softDeleteField(entitySchema); field != nil {
+		return field, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoSoftDelete, entitySchema.Name)
+}
+
+// softDeleteField return the gorm.DeletedAt field of s, nil if it has none
+func softDeleteField(s *schema.Schema) *schema.Field {
+	deletedAtType := reflect.TypeOf(gorm.DeletedAt{})
+	for _, field := range s.Fields {
+		if field.FieldType == deletedAtType && field.DBName != "" {
+			return field
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package reposity
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"sync/atomic"
+
+	"gorm.io/gorm"
+)
+
+// DefaultFetchSize is the number of rows fetched per round trip when streaming
+const DefaultFetchSize = 1000
+
+// cursorSeq make cursor names unique when several streams share one transaction
+var cursorSeq atomic.Uint64
+
+// StreamNoPaging run the query with current filter and yield items one by one,
+// no paging. Rows are read through a server-side cursor, fetchSize rows per round trip,
+// so memory usage does not grow with the size of the result set
+func (query *SQLQuery[M, E]) StreamNoPaging(ctx context.Context, sort string, fetchSize int) iter.Seq2[M, error] {
+	return streamItems[M, E](ctx, query.findDB().Order(orderClause(sort)).Where(query.expressStr, query.args...), fetchSize)
+}
+
+// StreamAllItemsIntoDTO read all items from database and yield them one by one as dto (data transfer object),
+// accepts generic types
+//
+// Rows are read through a server-side cursor, fetchSize rows per round trip
+func StreamAllItemsIntoDTO[M any, E any](ctx context.Context, sort string, fetchSize int) iter.Seq2[M, error] {
+	if !Connected {
+		return func(yield func(M, error) bool) {
+			var dto M
+			yield(dto, ErrNotConnected)
+		}
+	}
+	return streamItems[M, E](ctx, defaultDB.Order(orderClause(sort)), fetchSize)
+}
+
+// streamItems declare a cursor for the query built on db inside a transaction
+// (or a savepoint if db is already a transaction), then fetch and map rows lazily
+func streamItems[M any, E any](ctx context.Context, db *gorm.DB, fetchSize int) iter.Seq2[M, error] {
+	return func(yield func(M, error) bool) {
+		var dto M
+		if !Connected {
+			yield(dto, ErrNotConnected)
+			return
+		}
+		if fetchSize < 1 {
+			fetchSize = DefaultFetchSize
+		}
+
+		// Build the select statement without running it
+		var items []E
+		stmt := db.Session(&gorm.Session{DryRun: true}).Find(&items).Statement
+		if stmt.Error != nil {
+			yield(dto, stmt.Error)
+			return
+		}
+
+		cursor := fmt.Sprintf("reposity_cursor_%d", cursorSeq.Add(1))
+		stopped := false
+		err := db.Session(&gorm.Session{NewDB: true, Context: ctx}).Transaction(func(tx *gorm.DB) error {
+			conn := tx.Statement.ConnPool
+			if _, err := conn.ExecContext(ctx, "DECLARE "+cursor+" NO SCROLL CURSOR FOR "+stmt.SQL.String(), stmt.Vars...); err != nil {
+				return err
+			}
+
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				rows, err := conn.QueryContext(ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s", fetchSize, cursor))
+				if err != nil {
+					return err
+				}
+
+				fetched := 0
+				for rows.Next() {
+					fetched++
+					var item E
+					if err := tx.ScanRows(rows, &item); err != nil {
+						rows.Close()
+						return err
+					}
+
+					// Mapping from entity model to DTO model
+					var dto M
+					if err := MapToDTO(&dto, item); err != nil {
+						rows.Close()
+						return err
+					}
+					if !yield(dto, nil) {
+						stopped = true
+						rows.Close()
+						_, err := conn.ExecContext(ctx, "CLOSE "+cursor)
+						return err
+					}
+				}
+				if err := rows.Close(); err != nil {
+					return err
+				}
+				if err := rows.Err(); err != nil {
+					return err
+				}
+
+				// Cursor is exhausted
+				if fetched < fetchSize {
+					_, err := conn.ExecContext(ctx, "CLOSE "+cursor)
+					return err
+				}
+			}
+		})
+		if err != nil && !stopped {
+			yield(dto, dbError(err))
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package reposity
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/vi"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	vi_translations "github.com/go-playground/validator/v10/translations/vi"
+)
+
+// Locales of the validation messages
+const (
+	LocaleEnglish    = "en"
+	LocaleVietnamese = "vi"
+)
+
+// universalTranslator hold the translators of the supported locales, English is the fallback
+var universalTranslator = ut.New(en.New(), en.New(), vi.New())
+
+// defaultLocale is used when the context has no locale, see SetDefaultLocale
+var defaultLocale = LocaleEnglish
+
+// builtinMessages are the messages of the rules added by this package, per locale
+var builtinMessages = map[string]map[string]string{
+	LocaleEnglish: {
+		"unique":       "{field} is already taken",
+		"unique_items": "{field} must contain unique values",
+	},
+	LocaleVietnamese: {
+		"unique":       "{field} đã được sử dụng",
+		"unique_items": "{field} chỉ được chứa những giá trị không trùng lặp",
+	},
+}
+
+type localeKey struct{}
+
+func init() {
+	registerDefaults := map[string]func(*validator.Validate, ut.Translator) error{
+		LocaleEnglish:    en_translations.RegisterDefaultTranslations,
+		LocaleVietnamese: vi_translations.RegisterDefaultTranslations,
+	}
+	for locale, register := range registerDefaults {
+		trans, _ := universalTranslator.GetTranslator(locale)
+		if err := register(defaultValidator, trans); err != nil {
+			panic(fmt.Sprintf("register %s validation messages: %v", locale, err))
+		}
+
+		// "unique" is checked in database, except on slices and maps
+		messages := builtinMessages[locale]
+		err := defaultValidator.RegisterTranslation("unique", trans, noTranslationKeys, func(_ ut.Translator, fe validator.FieldError) string {
+			switch fe.Kind() {
+			case reflect.Slice, reflect.Array, reflect.Map:
+				return formatMessage(messages["unique_items"], fe)
+			}
+			return formatMessage(messages["unique"], fe)
+		})
+		if err != nil {
+			panic(fmt.Sprintf("register %s validation messages: %v", locale, err))
+		}
+	}
+}
+
+// WithLocale return a copy of ctx carrying the locale of validation messages, e.g. from the
+// Accept-Language header of a request: "vi", "vi-VN", "en"...
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, locale)
+}
+
+// LocaleFromContext return the locale set by WithLocale, or the default locale
+func LocaleFromContext(ctx context.Context) string {
+	if ctx != nil {
+		if locale, ok := ctx.Value(localeKey{}).(string); ok && locale != "" {
+			return locale
+		}
+	}
+	return defaultLocale
+}
+
+// SetDefaultLocale set the locale of validation messages when the context has none.
+// Like the validator, it must be configured before any validation
+func SetDefaultLocale(locale string) error {
+	if _, ok := universalTranslator.GetTranslator(locale); !ok {
+		return fmt.Errorf("unsupported locale %q", locale)
+	}
+	defaultLocale = locale
+	return nil
+}
+
+// Translator return the translator of locale, falling back on the language of a regional locale
+// ("vi-VN" to "vi") then on English. Use it to add locales specific translations to the validator
+func Translator(locale string) ut.Translator {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "-", "_"))
+	language, _, _ := strings.Cut(locale, "_")
+	trans, _ := universalTranslator.FindTranslator(locale, language)
+	return trans
+}
+
+// RegisterTranslation set the message of a rule in locale, for custom rules or to replace
+// a built-in message. "{field}" and "{param}" are replaced by the field name (json tag) and
+// the rule parameter, e.g. RegisterTranslation("vi", "even", "{field} phải có độ dài chẵn").
+// Like the validator, it must be configured before any validation
+func RegisterTranslation(locale, tag, message string) error {
+	trans, ok := universalTranslator.GetTranslator(locale)
+	if !ok {
+		return fmt.Errorf("unsupported locale %q", locale)
+	}
+	return defaultValidator.RegisterTranslation(tag, trans, noTranslationKeys, func(_ ut.Translator, fe validator.FieldError) string {
+		return formatMessage(message, fe)
+	})
+}
+
+// noTranslationKeys is the registration of messages formatted by formatMessage, which need no translator keys
+func noTranslationKeys(ut.Translator) error {
+	return nil
+}
+
+// formatMessage replace "{field}" and "{param}" in message
+func formatMessage(message string, fe validator.FieldError) string {
+	return strings.NewReplacer("{field}", fe.Field(), "{param}", fe.Param()).Replace(message)
+}
+
+// ruleMessage return the message of a field error in locale, a generic English message
+// if the rule has no translation
+func ruleMessage(fe validator.FieldError, locale string) string {
+	if message := fe.Translate(Translator(locale)); message != fe.Error() {
+		return message
+	}
+	if message := fe.Translate(Translator(LocaleEnglish)); message != fe.Error() {
+		return message
+	}
+	return fmt.Sprintf("%s failed on the '%s' rule", fe.Field(), fe.Tag())
+}
@@ -0,0 +1,371 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// UpsertPolicy decide what happens to the existing row when an insert conflicts
+type UpsertPolicy int
+
+const (
+	// UpsertUpdateAll overwrite all columns except primary keys and creation time
+	UpsertUpdateAll UpsertPolicy = iota
+	// UpsertUpdateColumns overwrite only UpsertOptions.UpdateColumns
+	UpsertUpdateColumns
+	// UpsertDoNothing keep the existing row untouched
+	UpsertDoNothing
+)
+
+// UpsertResult tell what happened to one upserted item
+type UpsertResult int
+
+const (
+	UpsertInserted UpsertResult = iota // a new row was inserted
+	UpsertUpdated                      // an existing row was updated
+	UpsertSkipped                      // the row conflicted and was left unchanged
+)
+
+func (r UpsertResult) String() string {
+	switch r {
+	case UpsertInserted:
+		return "inserted"
+	case UpsertUpdated:
+		return "updated"
+	default:
+		return "skipped"
+	}
+}
+
+// UpsertOptions configure the ON CONFLICT clause of UpsertFromDTO and UpsertManyFromDTO.
+// When neither ConflictColumns nor ConflictConstraint is set, the primary key is the conflict target
+type UpsertOptions struct {
+	ConflictColumns    []string // columns of the unique index used as conflict target
+	ConflictConstraint string   // name of the constraint used as conflict target, instead of columns
+	Policy             UpsertPolicy
+	UpdateColumns      []string // columns overwritten with UpsertUpdateColumns
+	// Where guard the update, the row is skipped when false. The proposed row is `excluded`,
+	// e.g. `"item"."updated_at" < excluded."updated_at"`
+	Where     string
+	WhereArgs []interface{}
+}
+
+// upsertRow scan a returned row together with the inserted flag
+type upsertRow[E any] struct {
+	Entity   E    `gorm:"embedded"`
+	Inserted bool `gorm:"column:reposity_inserted"`
+}
+
+// upsertReturning return all columns and whether the row was inserted:
+// xmax of a freshly inserted row version is 0
+var upsertReturning = clause.Returning{Columns: []clause.Column{
+	{Name: "*", Raw: true},
+	{Name: `(xmax = 0) AS "reposity_inserted"`, Raw: true},
+}}
+
+// UpsertFromDTO map dto (data transfer object) to database's item struct and insert it,
+// or update the existing item when it conflicts with opts' target, accepts generic types.
+// With hooks or audit, the existing item is locked first: the create hooks run when there is none, the update
+// hooks when it is updated. The conflict target must then be ConflictColumns or the primary key
+//
+// It return the written item, whether it was inserted, updated or skipped, and error
+func UpsertFromDTO[M any, E any](dto M, opts UpsertOptions) (M, UpsertResult, error) {
+	if !Connected {
+		return dto, UpsertSkipped, ErrNotConnected
+	}
+
+	// Validate dto object input, database backed rules like unique are left to the conflict handling
+	if err := Validate(dto); err != nil {
+		return dto, UpsertSkipped, err
+	}
+
+	// Mapping from DTO to entity model
+	var mapped E
+	if err := MapToEntity(&mapped, dto); err != nil {
+		return dto, UpsertSkipped, err
+	}
+
+	// dto is kept unchanged until the transaction commits, for retries
+	registered := hooksFor[M, E]()
+	var written M
+	var result UpsertResult
+	err := transaction(context.Background(), "UpsertFromDTO", false, func(tx *gorm.DB) (err error) {
+		item := mapped
+		written = dto
+		result, err = upsertItemWithHooks(tx, registered, &written, &item, opts)
+		return err
+	})
+	if err != nil {
+		return dto, result, err
+	}
+	return written, result, nil
+}
+
+// UpsertManyFromDTO upsert all dtos (data transfer object) in one transaction, accepts generic types.
+// Nothing is written if any item fails.
+//
+// It return written items, the result of each item and a *BatchError listing the failed items
+func UpsertManyFromDTO[M any, E any](dtos []M, opts UpsertOptions) ([]M, []UpsertResult, error) {
+	results := make([]UpsertResult, len(dtos))
+	if !Connected {
+		return dtos, results, ErrNotConnected
+	}
+
+	// Validate and map all items before writing anything
+	items := make([]E, len(dtos))
+	batchErr := &BatchError{}
+	for i := range dtos {
+		if err := Validate(dtos[i]); err != nil {
+			batchErr.Items = append(batchErr.Items, ItemError{Index: i, Err: err})
+			continue
+		}
+		if err := MapToEntity(&items[i], dtos[i]); err != nil {
+			batchErr.Items = append(batchErr.Items, ItemError{Index: i, Err: err})
+		}
+	}
+	if len(batchErr.Items) > 0 {
+		return dtos, results, batchErr
+	}
+
+	registered := hooksFor[M, E]()
+	written := make([]M, len(dtos))
+	err := transaction(context.Background(), "UpsertManyFromDTO", false, func(tx *gorm.DB) error {
+		for i := range items {
+			written[i] = dtos[i]
+			result, err := upsertItemWithHooks(tx, registered, &written[i], &items[i], opts)
+			if err != nil {
+				return &BatchError{Items: []ItemError{{Index: i, Err: err}}}
+			}
+			results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		return dtos, results, err
+	}
+	return written, results, nil
+}
+
+// errUpsertSkipped stop the update hooks of an upsert left unchanged by its WHERE guard
+var errUpsertSkipped = errors.New("upsert skipped")
+
+// upsertItemWithHooks upsert item with tx and map the written item back to dto. With hooks or audit,
+// the item conflicting with it is locked first: the create hooks run when there is none, the update
+// hooks when it is updated, and the write is audited as such
+func upsertItemWithHooks[M any, E any](tx *gorm.DB, registered []Hooks[M, E], dto *M, item *E, opts UpsertOptions) (UpsertResult, error) {
+	loaded := len(registered) > 0 || isAudited[E]()
+	var old *E
+	if loaded {
+		var err error
+		if old, err = lockConflictingItem(tx, item, opts); err != nil {
+			return UpsertSkipped, err
+		}
+	}
+
+	switch {
+	case !loaded || old != nil && opts.Policy == UpsertDoNothing:
+		result, err := upsertItem(tx, item, opts)
+		if err != nil {
+			return result, err
+		}
+		return result, MapToDTO(dto, *item)
+
+	case old == nil:
+		if err := beforeCreate(tx, registered, dto, item); err != nil {
+			return UpsertSkipped, err
+		}
+		result, err := upsertItem(tx, item, opts)
+		if err != nil {
+			return result, err
+		}
+		switch result {
+		case UpsertInserted:
+			return result, afterCreate(tx, registered, dto, item)
+		case UpsertUpdated:
+			// Inserted by another transaction since the lookup, the update hooks need the stored item
+			return result, fmt.Errorf("%w: conflicting item inserted concurrently", ErrSerialization)
+		}
+		return result, MapToDTO(dto, *item)
+	}
+
+	result := UpsertSkipped
+	err := updateWithHooks(tx, registered, old, dto, item, dto, func() (err error) {
+		if result, err = upsertItem(tx, item, opts); err != nil {
+			return err
+		}
+		if result == UpsertSkipped {
+			return errUpsertSkipped
+		}
+		return nil
+	})
+	if errors.Is(err, errUpsertSkipped) {
+		return result, MapToDTO(dto, *item)
+	}
+	return result, err
+}
+
+// lockConflictingItem read FOR UPDATE the stored item (soft deleted included) having the values of item
+// in the conflict columns of opts, or its primary key. It return nil if there is none
+func lockConflictingItem[E any](tx *gorm.DB, item *E, opts UpsertOptions) (*E, error) {
+	if opts.ConflictConstraint != "" {
+		return nil, errors.New("upsert: a ConflictConstraint target can not be used with hooks or audit, set ConflictColumns")
+	}
+	entitySchema, err := parseEntitySchema[E](tx)
+	if err != nil {
+		return nil, err
+	}
+	fields := entitySchema.PrimaryFields
+	if len(opts.ConflictColumns) > 0 {
+		fields = make([]*schema.Field, len(opts.ConflictColumns))
+		for i, column := range opts.ConflictColumns {
+			if fields[i] = entitySchema.LookUpField(column); fields[i] == nil || fields[i].DBName == "" {
+				return nil, fmt.Errorf("upsert: %s has no column %s", entitySchema.Name, column)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("upsert: %s has no primary key", entitySchema.Name)
+	}
+
+	ctx := statementContext(tx)
+	itemValue := reflect.ValueOf(item).Elem()
+	conds := make([]clause.Expression, len(fields))
+	for i, field := range fields {
+		value, zero := field.ValueOf(ctx, itemValue)
+		if zero && len(opts.ConflictColumns) == 0 {
+			// Primary key generated by the insert
+			return nil, nil
+		}
+		conds[i] = clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: value}
+	}
+
+	var old E
+	result := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Where(clause.And(conds...)).Limit(1).Find(&old)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &old, nil
+}
+
+// upsertItem run INSERT ... ON CONFLICT ... RETURNING for item and scan the written row back into it
+func upsertItem[E any](db *gorm.DB, item *E, opts UpsertOptions) (UpsertResult, error) {
+	onConflict := clause.OnConflict{OnConstraint: opts.ConflictConstraint}
+	for _, column := range opts.ConflictColumns {
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+	}
+	switch opts.Policy {
+	case UpsertDoNothing:
+		onConflict.DoNothing = true
+	case UpsertUpdateColumns:
+		if len(opts.UpdateColumns) == 0 {
+			return UpsertSkipped, errors.New("upsert: no update columns")
+		}
+		onConflict.DoUpdates = clause.AssignmentColumns(opts.UpdateColumns)
+	default:
+		onConflict.UpdateAll = true
+	}
+	if opts.Where != "" {
+		onConflict.Where = clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: opts.Where, Vars: opts.WhereArgs}}}
+	}
+
+	// Build the statement without GORM's create callbacks, they run the model hooks and cannot read
+	// the inserted flag. The model hooks are called around the write instead
+	if err := beforeUpsertHooks(db, item); err != nil {
+		return UpsertSkipped, err
+	}
+	stmt, err := upsertStatement(db, item, onConflict)
+	if err != nil {
+		return UpsertSkipped, err
+	}
+	rows, err := stmt.ConnPool.QueryContext(stmt.Context, stmt.SQL.String(), stmt.Vars...)
+	if err != nil {
+		return UpsertSkipped, dbError(err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		// Conflicting row left unchanged by DO NOTHING or the WHERE guard
+		return UpsertSkipped, dbError(rows.Err())
+	}
+	var row upsertRow[E]
+	if err := db.ScanRows(rows, &row); err != nil {
+		return UpsertSkipped, dbError(err)
+	}
+	*item = row.Entity
+
+	result := UpsertUpdated
+	if row.Inserted {
+		result = UpsertInserted
+	}
+	if err := afterUpsertHooks(db, item); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// upsertStatement build INSERT ... ON CONFLICT ... RETURNING for item, like GORM's create callback
+func upsertStatement(db *gorm.DB, item interface{}, onConflict clause.OnConflict) (*gorm.Statement, error) {
+	stmt := db.Session(&gorm.Session{NewDB: true}).Model(item).Statement
+	if err := stmt.Parse(item); err != nil {
+		return nil, err
+	}
+	stmt.Dest = item
+	stmt.ReflectValue = reflect.ValueOf(item).Elem()
+
+	for _, c := range stmt.Schema.CreateClauses {
+		stmt.AddClause(c)
+	}
+	stmt.AddClause(onConflict)
+	stmt.AddClause(upsertReturning)
+	stmt.AddClause(clause.Insert{})
+	stmt.AddClause(callbacks.ConvertToCreateValues(stmt))
+	if stmt.Error != nil {
+		return nil, stmt.Error
+	}
+	stmt.Build("INSERT", "VALUES", "ON CONFLICT", "RETURNING")
+	return stmt, stmt.Error
+}
+
+// beforeUpsertHooks call the BeforeSave and BeforeCreate hooks of item, like GORM's create callbacks
+func beforeUpsertHooks(db *gorm.DB, item interface{}) error {
+	if db.Statement.SkipHooks {
+		return nil
+	}
+	hookDB := db.Session(&gorm.Session{NewDB: true})
+	if hook, ok := item.(callbacks.BeforeSaveInterface); ok {
+		if err := hook.BeforeSave(hookDB); err != nil {
+			return err
+		}
+	}
+	if hook, ok := item.(callbacks.BeforeCreateInterface); ok {
+		return hook.BeforeCreate(hookDB)
+	}
+	return nil
+}
+
+// afterUpsertHooks call the AfterCreate and AfterSave hooks of a written item, like GORM's create callbacks
+func afterUpsertHooks(db *gorm.DB, item interface{}) error {
+	if db.Statement.SkipHooks {
+		return nil
+	}
+	hookDB := db.Session(&gorm.Session{NewDB: true})
+	if hook, ok := item.(callbacks.AfterCreateInterface); ok {
+		if err := hook.AfterCreate(hookDB); err != nil {
+			return err
+		}
+	}
+	if hook, ok := item.(callbacks.AfterSaveInterface); ok {
+		return hook.AfterSave(hookDB)
+	}
+	return nil
+}
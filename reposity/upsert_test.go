@@ -0,0 +1,75 @@
+package reposity
+
+import (
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type upsertProduct struct {
+	ID    int64 `gorm:"primaryKey"`
+	Code  string
+	Price int
+	calls *[]string
+}
+
+func (p *upsertProduct) BeforeCreate(*gorm.DB) error {
+	*p.calls = append(*p.calls, "before create")
+	return nil
+}
+
+func (p *upsertProduct) AfterCreate(*gorm.DB) error {
+	*p.calls = append(*p.calls, "after create")
+	return nil
+}
+
+func TestUpsertStatement(t *testing.T) {
+	db := newTestDB(t)
+	var calls []string
+	item := &upsertProduct{ID: 1, Code: "A1", Price: 10, calls: &calls}
+
+	tests := []struct {
+		name       string
+		onConflict clause.OnConflict
+		want       string
+	}{
+		{
+			name:       "update all",
+			onConflict: clause.OnConflict{UpdateAll: true},
+			want: `INSERT INTO "upsert_products" ("code","price","id") VALUES ($1,$2,$3) ` +
+				`ON CONFLICT ("id") DO UPDATE SET "code"="excluded"."code","price"="excluded"."price" ` +
+				`RETURNING *,(xmax = 0) AS "reposity_inserted"`,
+		},
+		{
+			name:       "do nothing",
+			onConflict: clause.OnConflict{Columns: []clause.Column{{Name: "code"}}, DoNothing: true},
+			want: `INSERT INTO "upsert_products" ("code","price","id") VALUES ($1,$2,$3) ` +
+				`ON CONFLICT ("code") DO NOTHING RETURNING *,(xmax = 0) AS "reposity_inserted"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := upsertStatement(db, item, tt.onConflict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stmt.SQL.String(); got != tt.want {
+				t.Errorf("sql = %s\nwant  %s", got, tt.want)
+			}
+		})
+	}
+	if len(calls) != 0 {
+		t.Errorf("building the statement ran hooks %v", calls)
+	}
+
+	if err := beforeUpsertHooks(db, item); err != nil {
+		t.Fatal(err)
+	}
+	if err := afterUpsertHooks(db, item); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0] != "before create" || calls[1] != "after create" {
+		t.Errorf("hooks = %v", calls)
+	}
+}
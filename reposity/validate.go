@@ -0,0 +1,280 @@
+package reposity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ValidationError is returned when a dto (data transfer object) fails validation.
+// Fields map the JSON path of each invalid field (e.g. "address.city") to its failed rules
+// and their messages, e.g. {"email": {"unique": "email is already taken"}}. Messages are in
+// the locale of the context (see WithLocale), use Translate for another locale
+type ValidationError struct {
+	Fields map[string]map[string]string
+	errs   validator.ValidationErrors
+}
+
+func (e *ValidationError) Error() string {
+	paths := make([]string, 0, len(e.Fields))
+	for path := range e.Fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var messages []string
+	for _, path := range paths {
+		rules := make([]string, 0, len(e.Fields[path]))
+		for rule := range e.Fields[path] {
+			rules = append(rules, rule)
+		}
+		sort.Strings(rules)
+		for _, rule := range rules {
+			messages = append(messages, e.Fields[path][rule])
+		}
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// Unwrap return the validator's errors, for callers using errors.As with validator.ValidationErrors
+func (e *ValidationError) Unwrap() error {
+	return e.errs
+}
+
+// Translate return the error with messages in locale, e.g. the locale of an HTTP request
+// when the helper was called without context
+func (e *ValidationError) Translate(locale string) *ValidationError {
+	return validationError(e.errs, locale).(*ValidationError)
+}
+
+// ValidationScope is given to database backed rules: the database (the transaction of the helper
+// being run), the schema of the entity being written and, for updates, the condition selecting
+// the item being updated, which must be left out of checks such as uniqueness
+type ValidationScope struct {
+	DB      *gorm.DB
+	Schema  *schema.Schema
+	Exclude clause.Expression // nil for new items
+}
+
+// DBValidationFunc check a field against the database, it return false if the field is invalid
+type DBValidationFunc func(ctx context.Context, scope ValidationScope, fl validator.FieldLevel) (bool, error)
+
+// validationRun is put in the context of a validation by the helpers, it carry the scope
+// of database backed rules and the first error they returned
+type validationRun struct {
+	scope ValidationScope
+	err   error
+}
+
+type validationRunKey struct{}
+
+// builtinValidator keep validator's own "unique" rule (unique slice or map items), which the
+// database backed "unique" rule falls back on for slices and maps
+var builtinValidator = validator.New()
+
+// defaultValidator is shared by all helpers so the validator's struct cache is kept between calls
+var defaultValidator = newValidator()
+
+// newValidator create the validator with field names taken from json tags and the built-in database rules
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	v.RegisterValidationCtx("unique", uniqueValidation)
+	return v
+}
+
+// Validator return the validator shared by all helpers, to register aliases, struct level rules
+// or type functions. Like the validator, it must be configured before any validation
+func Validator() *validator.Validate {
+	return defaultValidator
+}
+
+// RegisterValidation add a rule to the validator shared by all helpers, usable in `validate` tags.
+// message is the English message of the rule in ValidationError, see RegisterTranslation to
+// add other locales. An empty message keep the generic one
+func RegisterValidation(tag string, fn validator.Func, message string) error {
+	if err := defaultValidator.RegisterValidation(tag, fn); err != nil {
+		return err
+	}
+	if message == "" {
+		return nil
+	}
+	return RegisterTranslation(LocaleEnglish, tag, message)
+}
+
+// RegisterDBValidation add a rule checked against the database to the validator shared by all helpers,
+// like the built-in `unique` rule. The rule only runs when a dto is validated by a helper which knows
+// its entity (create, update, patch...), it is skipped by Validate
+func RegisterDBValidation(tag string, fn DBValidationFunc, message string) error {
+	if err := defaultValidator.RegisterValidationCtx(tag, dbValidation(fn)); err != nil {
+		return err
+	}
+	if message == "" {
+		return nil
+	}
+	return RegisterTranslation(LocaleEnglish, tag, message)
+}
+
+// Validate check dto (data transfer object) with the validator shared by all helpers, without
+// database backed rules
+//
+// It return a *ValidationError if dto is invalid, with messages in the default locale
+func Validate(dto interface{}) error {
+	return ValidateContext(context.Background(), dto)
+}
+
+// ValidateContext check dto like Validate, messages are in the locale of ctx
+//
+// It return a *ValidationError if dto is invalid
+func ValidateContext(ctx context.Context, dto interface{}) error {
+	return validationError(defaultValidator.StructCtx(ctx, dto), LocaleFromContext(ctx))
+}
+
+// dbValidation wrap a database backed rule into a validator function reading its scope from the context
+func dbValidation(fn DBValidationFunc) validator.FuncCtx {
+	return func(ctx context.Context, fl validator.FieldLevel) bool {
+		run, ok := ctx.Value(validationRunKey{}).(*validationRun)
+		if !ok {
+			return true
+		}
+		valid, err := fn(ctx, run.scope, fl)
+		if err != nil {
+			if run.err == nil {
+				run.err = err
+			}
+			return true
+		}
+		return valid
+	}
+}
+
+// uniqueValidation is the "unique" rule: on slices and maps, validator's rule checking items are
+// unique, on other fields the database backed uniqueRule
+func uniqueValidation(ctx context.Context, fl validator.FieldLevel) bool {
+	switch fl.Field().Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		tag := "unique"
+		if fl.Param() != "" {
+			tag += "=" + fl.Param()
+		}
+		return builtinValidator.Var(fl.Field().Interface(), tag) == nil
+	}
+	return dbValidation(uniqueRule)(ctx, fl)
+}
+
+// uniqueRule check that no other item of the entity has the field's value in the column given as
+// parameter (default the column of the field name), e.g. `validate:"unique=email"`. Empty values
+// are left to the required rule
+func uniqueRule(ctx context.Context, scope ValidationScope, fl validator.FieldLevel) (bool, error) {
+	field := fl.Field()
+	if field.IsZero() {
+		return true, nil
+	}
+
+	column := fl.Param()
+	if column == "" {
+		column = scope.DB.NamingStrategy.ColumnName("", fl.StructFieldName())
+	}
+	query := tableDB(scope.DB, scope.Schema).
+		Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: column}, Value: field.Interface()})
+	if scope.Exclude != nil {
+		query = query.Not(scope.Exclude)
+	}
+	var count int64
+	if err := query.WithContext(ctx).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+// validateItem validate dto of entity E, with database backed rules run on db.
+// exclude select the item being updated, nil for new items
+func validateItem[E any](db *gorm.DB, dto interface{}, exclude clause.Expression) error {
+	return runValidation[E](db, exclude, func(ctx context.Context) error {
+		return defaultValidator.StructCtx(ctx, dto)
+	})
+}
+
+// validateItemFields validate the fields of dto of entity E listed in paths (validator namespaces),
+// see validateItem
+func validateItemFields[E any](db *gorm.DB, dto interface{}, exclude clause.Expression, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	return runValidation[E](db, exclude, func(ctx context.Context) error {
+		return defaultValidator.StructPartialCtx(ctx, dto, paths...)
+	})
+}
+
+// runValidation run validate with the scope of database backed rules in its context
+func runValidation[E any](db *gorm.DB, exclude clause.Expression, validate func(ctx context.Context) error) error {
+	entitySchema, err := parseEntitySchema[E](db)
+	if err != nil {
+		return err
+	}
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	run := &validationRun{scope: ValidationScope{DB: db, Schema: entitySchema, Exclude: exclude}}
+	err = validate(context.WithValue(ctx, validationRunKey{}, run))
+	if run.err != nil {
+		return fmt.Errorf("validation: %w", run.err)
+	}
+	return validationError(err, LocaleFromContext(ctx))
+}
+
+// validationError convert validator's errors into a *ValidationError with messages in locale,
+// other errors are returned as is
+func validationError(err error, locale string) error {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return err
+	}
+
+	fields := make(map[string]map[string]string, len(validationErrs))
+	for _, fe := range validationErrs {
+		path := fieldPath(fe)
+		if fields[path] == nil {
+			fields[path] = map[string]string{}
+		}
+		fields[path][fe.Tag()] = ruleMessage(fe, locale)
+	}
+	return &ValidationError{Fields: fields, errs: validationErrs}
+}
+
+// fieldPath return the JSON path of a field error: its namespace without the root struct name
+func fieldPath(fe validator.FieldError) string {
+	namespace := fe.Namespace()
+	if _, path, ok := strings.Cut(namespace, "."); ok {
+		return path
+	}
+	return namespace
+}
+
+// nonZeroPaths return the validator namespaces of the non-empty fields of dto, the fields written
+// by updates which skip empty fields
+func nonZeroPaths(dto interface{}) []string {
+	value := reflect.Indirect(reflect.ValueOf(dto))
+	var fields []dtoField
+	for _, f := range dtoFields(value.Type()) {
+		if !value.FieldByIndex(f.Index).IsZero() {
+			fields = append(fields, f)
+		}
+	}
+	return structPaths(value.Type(), fields)
+}
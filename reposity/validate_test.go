@@ -0,0 +1,129 @@
+package reposity
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+)
+
+type validateAddressDTO struct {
+	City string `json:"city" validate:"required"`
+}
+
+// ValidateBaseDTO is exported: the fields of unexported embedded structs are not dto fields
+type ValidateBaseDTO struct {
+	Code string `json:"code" validate:"omitempty,len=3"`
+}
+
+type validateUserDTO struct {
+	ValidateBaseDTO
+	Name    string             `json:"name" validate:"required,min=2"`
+	Email   string             `json:"email" validate:"omitempty,email"`
+	Age     *int               `json:"age" validate:"omitempty,gte=18"`
+	Address validateAddressDTO `json:"address"`
+	Secret  string             `json:"-"`
+}
+
+func TestValidationError(t *testing.T) {
+	err := defaultValidator.Struct(validateUserDTO{Name: "a", Email: "bob"})
+	got := validationError(err, LocaleEnglish)
+
+	var validationErr *ValidationError
+	if !errors.As(got, &validationErr) {
+		t.Fatalf("validationError = %v, want a *ValidationError", got)
+	}
+	want := map[string]map[string]string{
+		"name":         {"min": "name must be at least 2 characters in length"},
+		"email":        {"email": "email must be a valid email address"},
+		"address.city": {"required": "city is a required field"},
+	}
+	if !reflect.DeepEqual(validationErr.Fields, want) {
+		t.Errorf("Fields = %v, want %v", validationErr.Fields, want)
+	}
+	if msg := validationErr.Error(); msg != "validation failed: city is a required field; email must be a valid email address; name must be at least 2 characters in length" {
+		t.Errorf("Error = %q", msg)
+	}
+
+	// Unwrap keep the validator's errors reachable
+	var validatorErrs validator.ValidationErrors
+	if !errors.As(got, &validatorErrs) || len(validatorErrs) != 3 {
+		t.Errorf("errors.As(validator.ValidationErrors) = %v", validatorErrs)
+	}
+
+	// Messages in another locale, same fields and rules
+	translated := validationErr.Translate(LocaleVietnamese)
+	if len(translated.Fields) != len(want) || translated.Fields["name"]["min"] == want["name"]["min"] {
+		t.Errorf("Translate = %v", translated.Fields)
+	}
+}
+
+func TestValidationErrorPassThrough(t *testing.T) {
+	if err := validationError(nil, LocaleEnglish); err != nil {
+		t.Errorf("validationError(nil) = %v", err)
+	}
+	other := errors.New("boom")
+	if err := validationError(other, LocaleEnglish); err != other {
+		t.Errorf("validationError(other) = %v, want it unchanged", err)
+	}
+}
+
+func TestValidationErrorGenericMessage(t *testing.T) {
+	v := validator.New()
+	if err := v.RegisterValidation("never", func(validator.FieldLevel) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	err := validationError(v.Var("x", "never"), LocaleEnglish)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("validationError = %v", err)
+	}
+	if msg := validationErr.Fields[""]["never"]; msg != " failed on the 'never' rule" {
+		t.Errorf("message = %q", msg)
+	}
+}
+
+func TestNonZeroPaths(t *testing.T) {
+	age := 0
+	tests := []struct {
+		name string
+		dto  interface{}
+		want []string
+	}{
+		{"empty", validateUserDTO{}, nil},
+		{"top level", validateUserDTO{Name: "Bob", Secret: "x"}, []string{"Name"}},
+		{"pointer to zero", &validateUserDTO{Age: &age}, []string{"Age"}},
+		{"embedded", validateUserDTO{ValidateBaseDTO: ValidateBaseDTO{Code: "abc"}}, []string{"ValidateBaseDTO.Code"}},
+		{"nested", validateUserDTO{Email: "bob@example.com", Address: validateAddressDTO{City: "Hanoi"}}, []string{"Email", "Address"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nonZeroPaths(tt.dto)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nonZeroPaths = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNonZeroPathsPartialValidation check only the written fields are validated by partial updates
+func TestNonZeroPathsPartialValidation(t *testing.T) {
+	dto := validateUserDTO{Email: "bob"}
+	err := validationError(defaultValidator.StructPartial(dto, nonZeroPaths(dto)...), LocaleEnglish)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("validationError = %v", err)
+	}
+	if len(validationErr.Fields) != 1 || validationErr.Fields["email"] == nil {
+		t.Errorf("Fields = %v, want only email", validationErr.Fields)
+	}
+
+	dto = validateUserDTO{Name: "Bob"}
+	if err := defaultValidator.StructPartial(dto, nonZeroPaths(dto)...); err != nil {
+		t.Errorf("StructPartial = %v, want required address.city skipped", err)
+	}
+}
@@ -0,0 +1,214 @@
+package reposity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ErrStaleObject is returned when an item was modified by someone else since it was read
+var ErrStaleObject = errors.New("stale object: item was modified concurrently")
+
+// UpdateItemByIDIfVersion update item by ID from dto (data transfer object) only if its version
+// still equals version, accepts generic types. The version column is the entity's `version` field,
+// which is incremented, or its auto update time field (updated_at), which is refreshed by GORM.
+// Empty (null) field will not be updated
+//
+// It return updated item (dto), and ErrStaleObject if the item was modified concurrently
+func UpdateItemByIDIfVersion[M any, E any, K comparable](id K, version interface{}, dto M) (M, error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return dto, err
+	}
+
+	entitySchema, err := parseEntitySchema[E](defaultDB)
+	if err != nil {
+		return dto, err
+	}
+	field := versionField(entitySchema)
+	if field == nil {
+		return dto, fmt.Errorf("%s has no version or updated_at column", entitySchema.Name)
+	}
+
+	// dto is kept unchanged until the transaction commits, for retries
+	var updated M
+	err = transaction(context.Background(), "UpdateItemByIDIfVersion", false, func(tx *gorm.DB) error {
+		// Validate non-empty fields of dto object input, the only ones updated
+		if err := validateItemFields[E](tx, dto, cond, nonZeroPaths(dto)); err != nil {
+			return err
+		}
+
+		// Check item exist by ID, old keep the stored values for hooks
+		var item E
+		if err := tx.Where(cond).First(&item).Error; err != nil {
+			return err
+		}
+		old := item
+
+		// Mapping from DTO to entity model, only the non-empty fields written by Updates are assigned
+		// so item hold the stored values after the update
+		var mapped E
+		if err := MapToEntity(&mapped, dto); err != nil {
+			return err
+		}
+		if err := assignNonZeroFields(tx, &item, &mapped); err != nil {
+			return err
+		}
+
+		// Bump a numeric version, time versions are refreshed by GORM on update
+		if field.AutoUpdateTime == 0 {
+			current, err := strconv.ParseInt(fmt.Sprint(version), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid version %v: %w", version, err)
+			}
+			next := reflect.New(field.FieldType).Elem()
+			next.SetInt(current + 1)
+			if err := field.Set(statementContext(tx), reflect.ValueOf(&item).Elem(), next.Interface()); err != nil {
+				return err
+			}
+		}
+
+		// Update item only if the version did not change, between the update hooks,
+		// then map it back to DTO
+		updated = dto
+		return updateWithHooks(tx, hooksFor[M, E](), &old, &updated, &item, &updated, func() error {
+			result := tx.Model(&item).
+				Where(cond).
+				Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: version}).
+				Updates(&item)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrStaleObject
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// UpdateItemByIDIfMatch lock item by ID, compare the ETag of its current dto (data transfer object)
+// with ifMatch (an HTTP If-Match header value), then update it from dto, accepts generic types.
+// Empty (null) field will not be updated
+//
+// It return updated item (dto), and ErrStaleObject if the ETag does not match
+func UpdateItemByIDIfMatch[M any, E any, K comparable](id K, ifMatch string, dto M) (M, error) {
+	if !Connected {
+		return dto, ErrNotConnected
+	}
+	cond, err := primaryKeyCondition[E](defaultDB, id)
+	if err != nil {
+		return dto, err
+	}
+
+	// dto is kept unchanged until the transaction commits, for retries
+	var updated M
+	err = transaction(context.Background(), "UpdateItemByIDIfMatch", false, func(tx *gorm.DB) error {
+		// Validate non-empty fields of dto object input, the only ones updated
+		if err := validateItemFields[E](tx, dto, cond, nonZeroPaths(dto)); err != nil {
+			return err
+		}
+
+		var item E
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(cond).First(&item).Error; err != nil {
+			return err
+		}
+
+		// Compare ETag of the current state
+		var current M
+		if err := MapToDTO(&current, item); err != nil {
+			return err
+		}
+		matched, err := MatchETag(current, ifMatch)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			return ErrStaleObject
+		}
+		old := item // stored values for hooks
+
+		// Mapping from DTO to entity model, only the non-empty fields written by Updates are assigned
+		// so item hold the stored values after the update
+		var mapped E
+		if err := MapToEntity(&mapped, dto); err != nil {
+			return err
+		}
+		if err := assignNonZeroFields(tx, &item, &mapped); err != nil {
+			return err
+		}
+
+		// Update item between the update hooks, then map it back to DTO
+		updated = dto
+		return updateWithHooks(tx, hooksFor[M, E](), &old, &updated, &item, &updated, func() error {
+			return tx.Model(&item).Where(cond).Updates(&item).Error
+		})
+	})
+	if err != nil {
+		return dto, err
+	}
+	return updated, nil
+}
+
+// ETag produce a strong HTTP entity tag from the JSON encoding of dto
+func ETag(dto interface{}) (string, error) {
+	data, err := json.Marshal(dto)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// MatchETag check dto against an HTTP If-Match header value: "*" or a comma separated list of ETags.
+// If-Match use the strong comparison of RFC 7232, weak ETags (W/"...") never match
+func MatchETag(dto interface{}, ifMatch string) (bool, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "*" {
+		return true, nil
+	}
+	etag, err := ETag(dto)
+	if err != nil {
+		return false, err
+	}
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// versionField find the version column of an entity: a numeric `version` field,
+// or else the auto update time field
+func versionField(s *schema.Schema) *schema.Field {
+	if field := s.LookUpField("version"); field != nil && field.DBName != "" {
+		switch field.FieldType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return field
+		}
+	}
+	for _, field := range s.Fields {
+		if field.AutoUpdateTime > 0 && field.DBName != "" {
+			return field
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package reposity
+
+import "testing"
+
+func TestMatchETag(t *testing.T) {
+	dto := struct {
+		Name string `json:"name"`
+	}{Name: "Bob"}
+	etag, err := ETag(dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		want    bool
+	}{
+		{"any", "*", true},
+		{"strong", etag, true},
+		{"list", `"other", ` + etag, true},
+		{"weak", "W/" + etag, false},
+		{"weak in list", `"other", W/` + etag, false},
+		{"different", `"other"`, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MatchETag(dto, tt.ifMatch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("MatchETag(%q) = %v, want %v", tt.ifMatch, got, tt.want)
+			}
+		})
+	}
+}